@@ -11,10 +11,13 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/whotterre/push_microservice/internal/client"
 	"github.com/whotterre/push_microservice/internal/config"
 	"github.com/whotterre/push_microservice/internal/initializers"
 	"github.com/whotterre/push_microservice/internal/queue"
+	"github.com/whotterre/push_microservice/internal/repository"
 	"github.com/whotterre/push_microservice/internal/routes"
+	"github.com/whotterre/push_microservice/internal/services"
 )
 
 func main() {
@@ -42,11 +45,29 @@ func main() {
 	defer conn.Close()
 
 	// Create producer
-	producer := queue.NewPushProducer(conn)
+	publishRoutes, err := queue.ParsePublishRoutes(cfg.PublishRoutes)
+	if err != nil {
+		log.Printf("Invalid PUBLISH_ROUTES: %v", err)
+		return
+	}
+	producer := queue.NewPushProducer(conn, queue.PublisherOptions{
+		Exchange:       cfg.PublishExchange,
+		Routes:         publishRoutes,
+		StatusExchange: cfg.StatusExchange,
+		PoolSize:       cfg.PublishPoolSize,
+		ConfirmTimeout: cfg.PublishConfirmTimeout,
+	})
+
+	// Select the push delivery backend
+	provider, err := client.NewPushProvider(cfg)
+	if err != nil {
+		log.Printf("Failed to create push provider: %v", err)
+		return
+	}
 
 	app := fiber.New()
 	app.Use(cors.New())
-	consumer := routes.SetupRoutes(app, cfg, db, conn, producer)
+	consumer, reconciler := routes.SetupRoutes(app, cfg, db, conn, producer, provider)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -57,6 +78,13 @@ func main() {
 		}
 	}()
 
+	// Relay status events written to the outbox
+	relay := services.NewOutboxRelay(repository.NewOutboxRepository(db), producer, cfg.OutboxPollInterval, cfg.OutboxBatchSize)
+	go relay.Run(ctx)
+
+	// Poll delivery outcomes and expire notifications that never get one
+	go reconciler.Run(ctx)
+
 	go func() {
 		port := ":" + cfg.Port
 		log.Printf("Starting server on port %s", port)
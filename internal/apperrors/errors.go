@@ -0,0 +1,111 @@
+package apperrors
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sentinel error kinds. Match with errors.Is.
+var (
+	ErrValidation        = errors.New("validation failed")
+	ErrNotFound          = errors.New("not found")
+	ErrConflict          = errors.New("conflict")
+	ErrInProgress        = errors.New("in progress")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrProviderTransient = errors.New("provider temporarily unavailable")
+	ErrProviderPermanent = errors.New("provider rejected the request")
+	ErrRateLimited       = errors.New("rate limited")
+)
+
+// Error tags an underlying error with one of the sentinel kinds
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// RateLimitError is returned when a provider throttles us. Match with errors.As
+// to read how long the provider asked us to wait.
+type RateLimitError struct {
+	RetryAfter time.Duration // zero when the provider gave no hint
+	Err        error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v (retry after %v)", e.Err, e.RetryAfter)
+	}
+	return e.Err.Error()
+}
+
+func (e *RateLimitError) Unwrap() []error {
+	return []error{ErrRateLimited, e.Err}
+}
+
+// Validation reports a malformed or incomplete request
+func Validation(format string, args ...interface{}) error {
+	return &Error{Kind: ErrValidation, Err: fmt.Errorf(format, args...)}
+}
+
+// NotFound reports a missing record or recipient
+func NotFound(format string, args ...interface{}) error {
+	return &Error{Kind: ErrNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+// Conflict reports a request that clashes with the current state, e.g. a
+// notification that was already cancelled
+func Conflict(format string, args ...interface{}) error {
+	return &Error{Kind: ErrConflict, Err: fmt.Errorf(format, args...)}
+}
+
+// InProgress reports a request that another attempt is still working on
+func InProgress(format string, args ...interface{}) error {
+	return &Error{Kind: ErrInProgress, Err: fmt.Errorf(format, args...)}
+}
+
+// Unauthorized reports a request whose credentials or signature did not check out
+func Unauthorized(format string, args ...interface{}) error {
+	return &Error{Kind: ErrUnauthorized, Err: fmt.Errorf(format, args...)}
+}
+
+// Transient marks err as a provider failure worth retrying
+func Transient(err error) error {
+	return &Error{Kind: ErrProviderTransient, Err: err}
+}
+
+// Permanent marks err as a provider failure that will not succeed on retry
+func Permanent(err error) error {
+	return &Error{Kind: ErrProviderPermanent, Err: err}
+}
+
+// RateLimited marks err as provider throttling
+func RateLimited(retryAfter time.Duration, err error) error {
+	return &RateLimitError{RetryAfter: retryAfter, Err: err}
+}
+
+// IsRetryable reports whether a failed operation may succeed if tried again.
+// Validation, not-found, conflict, unauthorized and permanent provider errors are final;
+// anything else, including an attempt in progress and errors of unknown kind, is worth
+// another bounded attempt.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch {
+	case errors.Is(err, ErrValidation),
+		errors.Is(err, ErrNotFound),
+		errors.Is(err, ErrConflict),
+		errors.Is(err, ErrUnauthorized),
+		errors.Is(err, ErrProviderPermanent):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,373 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+const (
+	ProviderAPNs = "apns"
+
+	apnsProductionEndpoint = "https://api.push.apple.com"
+	apnsSandboxEndpoint    = "https://api.sandbox.push.apple.com"
+	apnsMaxConcurrency     = 10
+
+	// Apple rejects provider tokens older than an hour and throttles refreshes
+	// more frequent than every 20 minutes
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// APNs reason codes
+const (
+	APNsReasonBadDeviceToken         = "BadDeviceToken"
+	APNsReasonUnregistered           = "Unregistered"
+	APNsReasonDeviceTokenNotForTopic = "DeviceTokenNotForTopic"
+	APNsReasonExpiredProviderToken   = "ExpiredProviderToken"
+	APNsReasonInvalidProviderToken   = "InvalidProviderToken"
+	APNsReasonTooManyRequests        = "TooManyRequests"
+	APNsReasonServiceUnavailable     = "ServiceUnavailable"
+	APNsReasonInternalServerError    = "InternalServerError"
+)
+
+// APNs push types
+const (
+	APNsPushTypeAlert      = "alert"
+	APNsPushTypeBackground = "background"
+)
+
+// APNsClient delivers notifications directly to Apple Push Notification service
+// using token-based (.p8) authentication
+type APNsClient struct {
+	keyID      string
+	teamID     string
+	topic      string
+	endpoint   string
+	key        *ecdsa.PrivateKey
+	httpClient *http.Client
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+func NewAPNsClient(cfg *config.Config) (*APNsClient, error) {
+	raw, err := os.ReadFile(cfg.APNsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APNs key: %w", err)
+	}
+
+	parsed, err := parsePKCS8PrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("APNs key is not an ECDSA key")
+	}
+
+	if cfg.APNsKeyID == "" || cfg.APNsTeamID == "" || cfg.APNsTopic == "" {
+		return nil, fmt.Errorf("APNs key ID, team ID and topic are required")
+	}
+
+	endpoint := apnsProductionEndpoint
+	if cfg.APNsSandbox {
+		endpoint = apnsSandboxEndpoint
+	}
+	if cfg.APNsEndpoint != "" {
+		endpoint = strings.TrimRight(cfg.APNsEndpoint, "/")
+	}
+
+	// APNs only speaks HTTP/2, which net/http negotiates over TLS via ALPN
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+	}
+
+	return &APNsClient{
+		keyID:      cfg.APNsKeyID,
+		teamID:     cfg.APNsTeamID,
+		topic:      cfg.APNsTopic,
+		endpoint:   endpoint,
+		key:        key,
+		httpClient: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+type apnsAlert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type apnsAps struct {
+	Alert            *apnsAlert `json:"alert,omitempty"`
+	Sound            string     `json:"sound,omitempty"`
+	ThreadID         string     `json:"thread-id,omitempty"`
+	ContentAvailable int        `json:"content-available,omitempty"`
+	MutableContent   int        `json:"mutable-content,omitempty"` // lets a service extension download image_url
+}
+
+type apnsErrorResponse struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// Name returns the provider identifier
+func (c *APNsClient) Name() string {
+	return ProviderAPNs
+}
+
+// Capabilities reports what APNs supports
+func (c *APNsClient) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Platforms:     []string{"ios"},
+		Segments:      false,
+		DeviceListing: false,
+	}
+}
+
+// SendToDevices sends one APNs request per device token
+func (c *APNsClient) SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error) {
+	// One payload per language the devices are in
+	payloads := make(map[string][]byte)
+	for _, device := range devices {
+		if _, ok := payloads[device.Locale]; ok {
+			continue
+		}
+		payload, err := buildAPNsPayload(msg.ForLocale(device.Locale))
+		if err != nil {
+			return nil, err
+		}
+		payloads[device.Locale] = payload
+	}
+
+	results := make([]DeviceResult, len(devices))
+	var lastErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apnsMaxConcurrency)
+
+	for i, device := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, device Device) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = DeviceResult{Token: device.Token}
+			apnsID, err := c.send(device.Token, payloads[device.Locale], msg)
+			if err != nil {
+				results[i].Error = err.Error()
+				results[i].Transient = IsTransientError(err)
+				var apiErr *APIError
+				if errors.As(err, &apiErr) {
+					results[i].ErrorCode = apiErr.Code
+					results[i].Unregistered = isAPNsTokenInvalid(apiErr.Code)
+				}
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			results[i].MessageID = apnsID
+		}(i, device)
+	}
+	wg.Wait()
+
+	res := &SendResult{Provider: ProviderAPNs, Results: results}
+	for _, r := range results {
+		if r.Error != "" {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", r.Token, r.Error))
+			continue
+		}
+		res.Recipients++
+		if res.ID == "" {
+			res.ID = r.MessageID
+		}
+	}
+
+	if res.Recipients == 0 && lastErr != nil {
+		return res, fmt.Errorf("apns: all %d sends failed: %w", len(devices), lastErr)
+	}
+	return res, nil
+}
+
+// SendToSegment is not supported by APNs
+func (c *APNsClient) SendToSegment(segment string, msg *PushMessage) (*SendResult, error) {
+	return nil, fmt.Errorf("apns does not support segments")
+}
+
+// ListDevices is not supported by APNs
+func (c *APNsClient) ListDevices(limit, offset int) (*PlayersResponse, error) {
+	return nil, fmt.Errorf("apns does not support device listing")
+}
+
+// send posts a notification to a single device token and returns the apns-id
+func (c *APNsClient) send(deviceToken string, payload []byte, msg *PushMessage) (string, error) {
+	token, err := c.getProviderToken()
+	if err != nil {
+		return "", err
+	}
+	apnsID, err := c.doSend(token, deviceToken, payload, msg)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == APNsReasonExpiredProviderToken {
+		// Our cached token aged out on Apple's side, mint a fresh one and try once more.
+		// Concurrent sends all see the expiry, but only the first replaces the token:
+		// Apple answers TooManyProviderTokenUpdates to a burst of new ones.
+		c.invalidateToken(token)
+		if token, err = c.getProviderToken(); err != nil {
+			return "", err
+		}
+		return c.doSend(token, deviceToken, payload, msg)
+	}
+	return apnsID, err
+}
+
+func (c *APNsClient) doSend(token, deviceToken string, payload []byte, msg *PushMessage) (string, error) {
+	apiUrl := fmt.Sprintf("%s/3/device/%s", c.endpoint, deviceToken)
+	req, err := http.NewRequest("POST", apiUrl, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	pushType := msg.PushType
+	if pushType == "" {
+		pushType = APNsPushTypeAlert
+	}
+
+	req.Header.Add("Authorization", "bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("apns-topic", c.topic)
+	req.Header.Add("apns-push-type", pushType)
+	req.Header.Add("apns-priority", apnsPriority(msg.Priority, pushType))
+	if msg.TTL != nil {
+		// 0 tells APNs to try once and not store the push; any other value is a timestamp
+		expiration := "0"
+		if *msg.TTL > 0 {
+			expiration = strconv.FormatInt(time.Now().Add(*msg.TTL).Unix(), 10)
+		}
+		req.Header.Add("apns-expiration", expiration)
+	}
+	if msg.CollapseID != "" {
+		req.Header.Add("apns-collapse-id", msg.CollapseID)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", requestError(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		apiErr := newAPIError(ProviderAPNs, res, body)
+		var errRes apnsErrorResponse
+		if err := json.Unmarshal(body, &errRes); err == nil && errRes.Reason != "" {
+			apiErr.Code = errRes.Reason
+			apiErr.Message = errRes.Reason
+		}
+		return "", apiErr
+	}
+
+	return res.Header.Get("apns-id"), nil
+}
+
+// getProviderToken returns the cached ES256 provider token, minting a new one when it ages out
+func (c *APNsClient) getProviderToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.jwt != "" && time.Since(c.issuedAt) < apnsTokenLifetime {
+		return c.jwt, nil
+	}
+
+	now := time.Now()
+	token, err := encodeJWT(
+		map[string]string{"alg": "ES256", "kid": c.keyID},
+		map[string]interface{}{"iss": c.teamID, "iat": now.Unix()},
+		es256Signer(c.key),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	c.jwt = token
+	c.issuedAt = now
+	return c.jwt, nil
+}
+
+// invalidateToken drops the cached provider token if it is still the one that failed
+func (c *APNsClient) invalidateToken(failed string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.jwt == failed {
+		c.jwt = ""
+	}
+}
+
+// buildAPNsPayload renders the aps dictionary with custom data alongside it
+func buildAPNsPayload(msg *PushMessage) ([]byte, error) {
+	payload := make(map[string]interface{}, len(msg.Data)+1)
+	for k, v := range msg.Data {
+		payload[k] = v
+	}
+
+	aps := apnsAps{}
+	if msg.Silent() {
+		aps.ContentAvailable = 1
+	} else {
+		aps.Alert = &apnsAlert{Title: msg.Title, Body: msg.Message}
+		aps.Sound = "default"
+		if msg.Sound != "" {
+			aps.Sound = msg.Sound
+		}
+		aps.ThreadID = msg.Group
+		if msg.ImageURL != "" {
+			aps.MutableContent = 1
+			payload["image_url"] = msg.ImageURL
+		}
+		if link := firstNonEmpty(msg.DeepLink, msg.URL); link != "" {
+			payload["deep_link"] = link
+		}
+	}
+	payload["aps"] = aps
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	return body, nil
+}
+
+// apnsPriority maps our priority onto apns-priority; background pushes must use 5
+func apnsPriority(priority, pushType string) string {
+	if pushType == APNsPushTypeBackground || priority == "normal" {
+		return "5"
+	}
+	return "10"
+}
+
+// isAPNsTokenInvalid reports whether the reason means the device token should be dropped
+func isAPNsTokenInvalid(reason string) bool {
+	switch reason {
+	case APNsReasonBadDeviceToken, APNsReasonUnregistered, APNsReasonDeviceTokenNotForTopic:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+// fakeAPNs records each request and answers with the reason scripted for its device token
+type fakeAPNs struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	payloads []map[string]interface{}
+	reasons  map[string][]apnsFakeReply // device token -> replies, one per request
+	expired  string                     // Authorization header answered with ExpiredProviderToken
+}
+
+type apnsFakeReply struct {
+	status int
+	reason string
+}
+
+func (f *fakeAPNs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var payload map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.requests = append(f.requests, r)
+	f.payloads = append(f.payloads, payload)
+
+	if f.expired != "" && r.Header.Get("Authorization") == f.expired {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(apnsErrorResponse{Reason: APNsReasonExpiredProviderToken})
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+	if replies := f.reasons[token]; len(replies) > 0 {
+		f.reasons[token] = replies[1:]
+		w.WriteHeader(replies[0].status)
+		_ = json.NewEncoder(w).Encode(apnsErrorResponse{Reason: replies[0].reason})
+		return
+	}
+	w.Header().Set("apns-id", "apns-"+token)
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTestAPNsClient(t *testing.T, fake *fakeAPNs) *APNsClient {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "AuthKey_KEY1.p8")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewAPNsClient(&config.Config{
+		APNsKeyFile:  keyFile,
+		APNsKeyID:    "KEY1",
+		APNsTeamID:   "TEAM1",
+		APNsTopic:    "com.example.app",
+		APNsEndpoint: server.URL,
+	})
+	if err != nil {
+		t.Fatalf("NewAPNsClient: %v", err)
+	}
+	return c
+}
+
+func TestAPNsSendToDevices(t *testing.T) {
+	fake := &fakeAPNs{}
+	c := newTestAPNsClient(t, fake)
+
+	ttl := time.Hour
+	msg := &PushMessage{Title: "Order shipped", Message: "On its way", Priority: "high", TTL: &ttl, CollapseID: "order-1",
+		Data: map[string]interface{}{"order_id": "1"}}
+	res, err := c.SendToDevices([]Device{{Token: "device-a", Platform: "ios"}}, msg)
+	if err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	if res.Recipients != 1 || res.ID != "apns-device-a" {
+		t.Errorf("result = %+v, want one recipient with the apns-id", res)
+	}
+
+	req := fake.requests[0]
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "bearer ") {
+		t.Errorf("Authorization = %q, want a bearer provider token", req.Header.Get("Authorization"))
+	}
+	want := map[string]string{
+		"apns-topic":       "com.example.app",
+		"apns-push-type":   APNsPushTypeAlert,
+		"apns-priority":    "10",
+		"apns-collapse-id": "order-1",
+	}
+	for header, value := range want {
+		if got := req.Header.Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+	expiration, err := strconv.ParseInt(req.Header.Get("apns-expiration"), 10, 64)
+	if err != nil || time.Until(time.Unix(expiration, 0)) < 59*time.Minute {
+		t.Errorf("apns-expiration = %q, want about an hour from now", req.Header.Get("apns-expiration"))
+	}
+
+	aps, _ := fake.payloads[0]["aps"].(map[string]interface{})
+	alert, _ := aps["alert"].(map[string]interface{})
+	if alert["title"] != "Order shipped" || alert["body"] != "On its way" || fake.payloads[0]["order_id"] != "1" {
+		t.Errorf("payload = %v, want the alert and custom data", fake.payloads[0])
+	}
+}
+
+func TestAPNsZeroTTLIsNowOrNever(t *testing.T) {
+	fake := &fakeAPNs{}
+	c := newTestAPNsClient(t, fake)
+
+	ttl := time.Duration(0)
+	if _, err := c.SendToDevices([]Device{{Token: "device-a"}}, &PushMessage{Title: "hi", TTL: &ttl}); err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	if got := fake.requests[0].Header.Get("apns-expiration"); got != "0" {
+		t.Errorf("apns-expiration = %q, want 0", got)
+	}
+}
+
+func TestAPNsSilentPush(t *testing.T) {
+	fake := &fakeAPNs{}
+	c := newTestAPNsClient(t, fake)
+
+	msg := &PushMessage{Priority: "high", PushType: APNsPushTypeBackground, Data: map[string]interface{}{"sync": "inbox"}}
+	if _, err := c.SendToDevices([]Device{{Token: "device-a"}}, msg); err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	req := fake.requests[0]
+	if req.Header.Get("apns-push-type") != APNsPushTypeBackground || req.Header.Get("apns-priority") != "5" {
+		t.Errorf("push type %q priority %q, want background at 5", req.Header.Get("apns-push-type"), req.Header.Get("apns-priority"))
+	}
+	aps, _ := fake.payloads[0]["aps"].(map[string]interface{})
+	if aps["content-available"] != float64(1) || aps["alert"] != nil {
+		t.Errorf("aps = %v, want content-available and no alert", aps)
+	}
+}
+
+func TestAPNsClassifiesDeviceErrors(t *testing.T) {
+	fake := &fakeAPNs{reasons: map[string][]apnsFakeReply{
+		"device-gone": {{status: http.StatusGone, reason: APNsReasonUnregistered}},
+		"device-busy": {{status: http.StatusServiceUnavailable, reason: APNsReasonServiceUnavailable}},
+	}}
+	c := newTestAPNsClient(t, fake)
+
+	res, err := c.SendToDevices([]Device{{Token: "device-ok"}, {Token: "device-gone"}, {Token: "device-busy"}}, &PushMessage{Title: "hi"})
+	if err != nil {
+		t.Fatalf("SendToDevices: %v, want nil while a device succeeded", err)
+	}
+	gone, busy := res.Results[1], res.Results[2]
+	if gone.ErrorCode != APNsReasonUnregistered || !gone.Unregistered || gone.Transient {
+		t.Errorf("unregistered token result = %+v", gone)
+	}
+	if busy.ErrorCode != APNsReasonServiceUnavailable || busy.Unregistered || !busy.Transient {
+		t.Errorf("unavailable result = %+v", busy)
+	}
+}
+
+func TestAPNsRefreshesExpiredProviderToken(t *testing.T) {
+	fake := &fakeAPNs{reasons: map[string][]apnsFakeReply{
+		"device-a": {{status: http.StatusForbidden, reason: APNsReasonExpiredProviderToken}},
+	}}
+	c := newTestAPNsClient(t, fake)
+
+	if _, err := c.SendToDevices([]Device{{Token: "device-a"}}, &PushMessage{Title: "hi"}); err != nil {
+		t.Fatalf("SendToDevices: %v, want the retry with a fresh token to succeed", err)
+	}
+	if len(fake.requests) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(fake.requests))
+	}
+	if fake.requests[0].Header.Get("Authorization") == fake.requests[1].Header.Get("Authorization") {
+		t.Error("retry reused the expired provider token")
+	}
+}
+
+func TestAPNsConcurrentExpiryRefreshesTheTokenOnce(t *testing.T) {
+	fake := &fakeAPNs{}
+	c := newTestAPNsClient(t, fake)
+	expired, err := c.getProviderToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.expired = "bearer " + expired
+
+	devices := make([]Device, 8)
+	for i := range devices {
+		devices[i] = Device{Token: "device-" + strconv.Itoa(i)}
+	}
+	if _, err := c.SendToDevices(devices, &PushMessage{Title: "hi"}); err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+
+	tokens := make(map[string]bool)
+	for _, req := range fake.requests {
+		tokens[req.Header.Get("Authorization")] = true
+	}
+	if len(tokens) != 2 {
+		t.Errorf("sent with %d provider tokens, want the expired one and a single replacement", len(tokens))
+	}
+}
+
+func TestAPNsAllSendsFailed(t *testing.T) {
+	fake := &fakeAPNs{reasons: map[string][]apnsFakeReply{
+		"device-bad": {{status: http.StatusBadRequest, reason: APNsReasonBadDeviceToken}},
+	}}
+	c := newTestAPNsClient(t, fake)
+
+	_, err := c.SendToDevices([]Device{{Token: "device-bad"}}, &PushMessage{Title: "hi"})
+	if !errors.Is(err, apperrors.ErrProviderPermanent) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+}
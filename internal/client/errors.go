@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+)
+
+// APIError is returned when a push provider responds with a non-2xx status.
+// It classifies itself by status for errors.Is / errors.As: 429 is rate limiting,
+// 5xx is transient and any other 4xx is permanent.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	Code       string // provider-specific error code, e.g. UNREGISTERED
+	Message    string
+	RetryAfter time.Duration // from the Retry-After header, if any
+}
+
+// newAPIError builds an APIError from a provider response
+func newAPIError(provider string, res *http.Response, body []byte) *APIError {
+	return &APIError{
+		Provider:   provider,
+		StatusCode: res.StatusCode,
+		Message:    string(body),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s API error (status %d, %s): %s", e.Provider, e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s API error (status %d): %s", e.Provider, e.StatusCode, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case apperrors.ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case apperrors.ErrProviderTransient:
+		return e.StatusCode >= 500
+	case apperrors.ErrProviderPermanent:
+		return e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests
+	}
+	return false
+}
+
+func (e *APIError) As(target interface{}) bool {
+	if t, ok := target.(**apperrors.RateLimitError); ok && e.StatusCode == http.StatusTooManyRequests {
+		*t = &apperrors.RateLimitError{RetryAfter: e.RetryAfter, Err: e}
+		return true
+	}
+	return false
+}
+
+// requestError wraps a transport failure (DNS, refused connection, timeout) as transient
+func requestError(err error) error {
+	return apperrors.Transient(fmt.Errorf("failed to send request: %w", err))
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,457 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+const (
+	ProviderFCM = "fcm"
+
+	fcmDefaultEndpoint = "https://fcm.googleapis.com"
+	fcmDefaultTokenURL = "https://oauth2.googleapis.com/token"
+	fcmScope           = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmErrorType       = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+	fcmMaxConcurrency  = 10
+)
+
+// FCM HTTP v1 error codes
+const (
+	FCMErrorUnregistered     = "UNREGISTERED"
+	FCMErrorInvalidArgument  = "INVALID_ARGUMENT"
+	FCMErrorSenderIDMismatch = "SENDER_ID_MISMATCH"
+	FCMErrorQuotaExceeded    = "QUOTA_EXCEEDED"
+	FCMErrorUnavailable      = "UNAVAILABLE"
+	FCMErrorInternal         = "INTERNAL"
+	FCMErrorThirdPartyAuth   = "THIRD_PARTY_AUTH_ERROR"
+)
+
+// serviceAccount is the subset of a Google service account key file we need
+type serviceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// FCMClient delivers notifications through the Firebase Cloud Messaging HTTP v1 API
+type FCMClient struct {
+	projectID  string
+	endpoint   string
+	tokenURL   string
+	account    serviceAccount
+	key        *rsa.PrivateKey
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func NewFCMClient(cfg *config.Config) (*FCMClient, error) {
+	raw, err := os.ReadFile(cfg.FCMCredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FCM credentials: %w", err)
+	}
+
+	var account serviceAccount
+	if err := json.Unmarshal(raw, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse FCM credentials: %w", err)
+	}
+
+	parsed, err := parsePKCS8PrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("FCM service account key is not an RSA key")
+	}
+
+	projectID := cfg.FCMProjectID
+	if projectID == "" {
+		projectID = account.ProjectID
+	}
+	if projectID == "" {
+		return nil, fmt.Errorf("FCM project ID is not configured")
+	}
+
+	endpoint := strings.TrimRight(cfg.FCMEndpoint, "/")
+	if endpoint == "" {
+		endpoint = fcmDefaultEndpoint
+	}
+
+	// An explicit override wins so the client can be pointed at a local fake server
+	tokenURL := cfg.FCMTokenURL
+	if tokenURL == "" {
+		tokenURL = account.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = fcmDefaultTokenURL
+	}
+
+	return &FCMClient{
+		projectID:  projectID,
+		endpoint:   endpoint,
+		tokenURL:   tokenURL,
+		account:    account,
+		key:        key,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type fcmNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	Image string `json:"image,omitempty"`
+}
+
+type fcmAndroidNotification struct {
+	ChannelID string `json:"channel_id,omitempty"`
+	Sound     string `json:"sound,omitempty"`
+	Tag       string `json:"tag,omitempty"`
+}
+
+type fcmAndroidConfig struct {
+	Priority     string                  `json:"priority,omitempty"` // HIGH | NORMAL
+	TTL          string                  `json:"ttl,omitempty"`      // seconds with an s suffix, e.g. 3600s
+	CollapseKey  string                  `json:"collapse_key,omitempty"`
+	Notification *fcmAndroidNotification `json:"notification,omitempty"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token,omitempty"`
+	Topic        string            `json:"topic,omitempty"`
+	Notification *fcmNotification  `json:"notification,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Android      *fcmAndroidConfig `json:"android,omitempty"`
+}
+
+// newFCMMessage builds the FCM message for a localized push message
+func newFCMMessage(msg *PushMessage) fcmMessage {
+	message := fcmMessage{Data: stringifyData(msg.Data), Android: newFCMAndroidConfig(msg)}
+	// Without a notification block FCM hands the data to the app, which shows nothing
+	if msg.Silent() {
+		return message
+	}
+	message.Notification = &fcmNotification{Title: msg.Title, Body: msg.Message, Image: msg.ImageURL}
+	// FCM has no click URL field, apps read the link from the data
+	if link := firstNonEmpty(msg.DeepLink, msg.URL); link != "" {
+		if message.Data == nil {
+			message.Data = make(map[string]string)
+		}
+		message.Data["deep_link"] = link
+	}
+	if msg.AndroidChannelID != "" || msg.Sound != "" || msg.Group != "" {
+		if message.Android == nil {
+			message.Android = &fcmAndroidConfig{}
+		}
+		message.Android.Notification = &fcmAndroidNotification{
+			ChannelID: msg.AndroidChannelID,
+			Sound:     msg.Sound,
+			Tag:       msg.Group,
+		}
+	}
+	return message
+}
+
+// newFCMAndroidConfig carries priority, time to live and collapse key, or is nil when
+// none is set and FCM's defaults apply
+func newFCMAndroidConfig(msg *PushMessage) *fcmAndroidConfig {
+	if msg.Priority == "" && msg.TTL == nil && msg.CollapseID == "" {
+		return nil
+	}
+	android := &fcmAndroidConfig{CollapseKey: msg.CollapseID}
+	switch msg.Priority {
+	case "high":
+		android.Priority = "HIGH"
+	case "normal":
+		android.Priority = "NORMAL"
+	}
+	if msg.TTL != nil {
+		android.TTL = fmt.Sprintf("%ds", int(msg.TTL.Seconds()))
+	}
+	return android
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+type fcmSendRequest struct {
+	Message fcmMessage `json:"message"`
+}
+
+type fcmSendResponse struct {
+	Name string `json:"name"`
+}
+
+type fcmErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type      string `json:"@type"`
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// Name returns the provider identifier
+func (c *FCMClient) Name() string {
+	return ProviderFCM
+}
+
+// Capabilities reports what FCM supports
+func (c *FCMClient) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Platforms:     []string{"android", "web"},
+		Segments:      true, // segments map onto FCM topics
+		DeviceListing: false,
+	}
+}
+
+// SendToDevices sends one FCM message per registration token
+func (c *FCMClient) SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error) {
+	results := make([]DeviceResult, len(devices))
+	var lastErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fcmMaxConcurrency)
+
+	for i, device := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, device Device) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = DeviceResult{Token: device.Token}
+			message := newFCMMessage(msg.ForLocale(device.Locale))
+			message.Token = device.Token
+			name, err := c.send(message)
+			if err != nil {
+				results[i].Error = err.Error()
+				results[i].Transient = IsTransientError(err)
+				var apiErr *APIError
+				if errors.As(err, &apiErr) {
+					results[i].ErrorCode = apiErr.Code
+					results[i].Unregistered = isFCMTokenInvalid(apiErr)
+				}
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			results[i].MessageID = name
+		}(i, device)
+	}
+	wg.Wait()
+
+	res := &SendResult{Provider: ProviderFCM, Results: results}
+	for _, r := range results {
+		if r.Error != "" {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", r.Token, r.Error))
+			continue
+		}
+		res.Recipients++
+		if res.ID == "" {
+			res.ID = r.MessageID
+		}
+	}
+
+	if res.Recipients == 0 && lastErr != nil {
+		return res, fmt.Errorf("fcm: all %d sends failed: %w", len(devices), lastErr)
+	}
+	return res, nil
+}
+
+// SendToSegment sends to an FCM topic named after the segment
+func (c *FCMClient) SendToSegment(segment string, msg *PushMessage) (*SendResult, error) {
+	message := newFCMMessage(msg)
+	message.Topic = segment
+	name, err := c.send(message)
+	if err != nil {
+		return nil, err
+	}
+	return &SendResult{Provider: ProviderFCM, ID: name}, nil
+}
+
+// ListDevices is not supported by FCM
+func (c *FCMClient) ListDevices(limit, offset int) (*PlayersResponse, error) {
+	return nil, fmt.Errorf("fcm does not support device listing")
+}
+
+// send posts a single message to the FCM v1 messages:send endpoint
+func (c *FCMClient) send(message fcmMessage) (string, error) {
+	token, err := c.getAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(fcmSendRequest{Message: message})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	apiUrl := fmt.Sprintf("%s/v1/projects/%s/messages:send", c.endpoint, c.projectID)
+	req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", requestError(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", parseFCMError(res, body)
+	}
+
+	var sendRes fcmSendResponse
+	if err := json.Unmarshal(body, &sendRes); err != nil {
+		return "", fmt.Errorf("failed to parse response: %w", err)
+	}
+	return sendRes.Name, nil
+}
+
+// getAccessToken returns a cached OAuth2 access token, minting a new one when needed
+func (c *FCMClient) getAccessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Before(c.expiresAt) {
+		return c.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := encodeJWT(
+		map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.account.PrivateKeyID},
+		map[string]interface{}{
+			"iss":   c.account.ClientEmail,
+			"scope": fcmScope,
+			"aud":   c.tokenURL,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		rs256Signer(c.key),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+
+	res, err := c.httpClient.PostForm(c.tokenURL, form)
+	if err != nil {
+		return "", apperrors.Transient(fmt.Errorf("failed to request access token: %w", err))
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token response: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		apiErr := newAPIError(ProviderFCM, res, body)
+		apiErr.Message = "token exchange failed: " + apiErr.Message
+		return "", apiErr
+	}
+
+	var tokenRes struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenRes); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %w", err)
+	}
+
+	// Refresh a minute early so in-flight requests never carry an expired token
+	c.accessToken = tokenRes.AccessToken
+	c.expiresAt = now.Add(time.Duration(tokenRes.ExpiresIn)*time.Second - time.Minute)
+	return c.accessToken, nil
+}
+
+// parseFCMError maps an FCM error body onto an APIError carrying the FCM error code
+func parseFCMError(res *http.Response, body []byte) error {
+	apiErr := newAPIError(ProviderFCM, res, body)
+
+	var errRes fcmErrorResponse
+	if err := json.Unmarshal(body, &errRes); err != nil {
+		return apiErr
+	}
+
+	apiErr.Message = errRes.Error.Message
+	apiErr.Code = errRes.Error.Status
+	for _, detail := range errRes.Error.Details {
+		if detail.Type == fcmErrorType && detail.ErrorCode != "" {
+			apiErr.Code = detail.ErrorCode
+			break
+		}
+	}
+	return apiErr
+}
+
+// isFCMTokenInvalid reports whether the error means the registration token should be dropped
+func isFCMTokenInvalid(err *APIError) bool {
+	switch err.Code {
+	case FCMErrorUnregistered, FCMErrorSenderIDMismatch:
+		return true
+	case FCMErrorInvalidArgument:
+		// INVALID_ARGUMENT also covers malformed payloads, only drop the token when FCM blames it
+		return strings.Contains(strings.ToLower(err.Message), "registration token")
+	}
+	return false
+}
+
+// stringifyData converts notification data into the string map FCM requires
+func stringifyData(data map[string]interface{}) map[string]string {
+	if len(data) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			out[k] = s
+			continue
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			out[k] = fmt.Sprint(v)
+			continue
+		}
+		out[k] = string(encoded)
+	}
+	return out
+}
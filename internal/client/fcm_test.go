@@ -0,0 +1,205 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+// fakeFCM serves the OAuth2 token endpoint and messages:send, failing the tokens in errors
+type fakeFCM struct {
+	mu          sync.Mutex
+	tokenCalls  int
+	messages    []fcmMessage
+	errors      map[string]fakeFCMError
+	accessToken string
+}
+
+type fakeFCMError struct {
+	status     int
+	grpcStatus string // the error's canonical status, e.g. NOT_FOUND
+	errorCode  string // the FcmError detail, e.g. UNREGISTERED
+	message    string
+}
+
+func (f *fakeFCM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/token":
+		if err := r.ParseForm(); err != nil || r.Form.Get("assertion") == "" {
+			http.Error(w, "missing assertion", http.StatusBadRequest)
+			return
+		}
+		f.tokenCalls++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": f.accessToken, "expires_in": 3600})
+	case "/v1/projects/test-project/messages:send":
+		if r.Header.Get("Authorization") != "Bearer "+f.accessToken {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		var req fcmSendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.messages = append(f.messages, req.Message)
+		if e, ok := f.errors[req.Message.Token]; ok {
+			w.WriteHeader(e.status)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]interface{}{
+					"code":    e.status,
+					"message": e.message,
+					"status":  e.grpcStatus,
+					"details": []map[string]string{{"@type": fcmErrorType, "errorCode": e.errorCode}},
+				},
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(fcmSendResponse{Name: "projects/test-project/messages/" + req.Message.Token})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestFCMClient(t *testing.T, fake *fakeFCM) *FCMClient {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := json.Marshal(serviceAccount{
+		ProjectID:    "test-project",
+		PrivateKeyID: "key-1",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		ClientEmail:  "push@test-project.iam.gserviceaccount.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(credentials, account, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewFCMClient(&config.Config{
+		FCMCredentialsFile: credentials,
+		FCMEndpoint:        server.URL,
+		FCMTokenURL:        server.URL + "/token",
+	})
+	if err != nil {
+		t.Fatalf("NewFCMClient: %v", err)
+	}
+	return c
+}
+
+func TestFCMSendToDevices(t *testing.T) {
+	fake := &fakeFCM{accessToken: "access-1"}
+	c := newTestFCMClient(t, fake)
+
+	ttl := 5 * time.Minute
+	msg := &PushMessage{Title: "Your code", Message: "123456", Priority: "high", TTL: &ttl, CollapseID: "login-code",
+		Data: map[string]interface{}{"attempt": 2}}
+	res, err := c.SendToDevices([]Device{{Token: "token-a", Platform: "android"}, {Token: "token-b", Platform: "android"}}, msg)
+	if err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+
+	if res.Recipients != 2 || res.Provider != ProviderFCM {
+		t.Errorf("result = %+v, want 2 recipients through fcm", res)
+	}
+	if fake.tokenCalls != 1 {
+		t.Errorf("token exchanged %d times, want the access token cached", fake.tokenCalls)
+	}
+	for _, message := range fake.messages {
+		if message.Notification == nil || message.Notification.Title != "Your code" || message.Notification.Body != "123456" {
+			t.Errorf("notification = %+v, want the title and message", message.Notification)
+		}
+		if message.Android == nil || message.Android.Priority != "HIGH" || message.Android.TTL != "300s" || message.Android.CollapseKey != "login-code" {
+			t.Errorf("android config = %+v, want HIGH, 300s and the collapse key", message.Android)
+		}
+		if message.Data["attempt"] != "2" {
+			t.Errorf("data = %v, want values stringified", message.Data)
+		}
+	}
+}
+
+func TestFCMSilentPushHasNoNotificationBlock(t *testing.T) {
+	fake := &fakeFCM{accessToken: "access-1"}
+	c := newTestFCMClient(t, fake)
+
+	msg := &PushMessage{Data: map[string]interface{}{"sync": "inbox"}, PushType: APNsPushTypeBackground}
+	if _, err := c.SendToDevices([]Device{{Token: "token-a", Platform: "android"}}, msg); err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	if len(fake.messages) != 1 || fake.messages[0].Notification != nil {
+		t.Errorf("messages = %+v, want a data-only message", fake.messages)
+	}
+}
+
+func TestFCMClassifiesDeviceErrors(t *testing.T) {
+	fake := &fakeFCM{
+		accessToken: "access-1",
+		errors: map[string]fakeFCMError{
+			"token-gone": {status: http.StatusNotFound, grpcStatus: "NOT_FOUND", errorCode: FCMErrorUnregistered, message: "Requested entity was not found."},
+			"token-busy": {status: http.StatusServiceUnavailable, grpcStatus: "UNAVAILABLE", errorCode: FCMErrorUnavailable, message: "The service is currently unavailable."},
+		},
+	}
+	c := newTestFCMClient(t, fake)
+
+	res, err := c.SendToDevices([]Device{{Token: "token-ok"}, {Token: "token-gone"}, {Token: "token-busy"}}, &PushMessage{Title: "hi"})
+	if err != nil {
+		t.Fatalf("SendToDevices: %v, want nil while a device succeeded", err)
+	}
+	if res.Recipients != 1 {
+		t.Errorf("recipients = %d, want 1", res.Recipients)
+	}
+
+	gone, busy := res.Results[1], res.Results[2]
+	if gone.ErrorCode != FCMErrorUnregistered || !gone.Unregistered || gone.Transient {
+		t.Errorf("unregistered token result = %+v", gone)
+	}
+	if busy.ErrorCode != FCMErrorUnavailable || busy.Unregistered || !busy.Transient {
+		t.Errorf("unavailable result = %+v", busy)
+	}
+}
+
+func TestFCMAllSendsFailed(t *testing.T) {
+	fake := &fakeFCM{
+		accessToken: "access-1",
+		errors: map[string]fakeFCMError{
+			"token-gone": {status: http.StatusNotFound, grpcStatus: "NOT_FOUND", errorCode: FCMErrorUnregistered, message: "Requested entity was not found."},
+		},
+	}
+	c := newTestFCMClient(t, fake)
+
+	_, err := c.SendToDevices([]Device{{Token: "token-gone"}}, &PushMessage{Title: "hi"})
+	if !errors.Is(err, apperrors.ErrProviderPermanent) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != FCMErrorUnregistered {
+		t.Errorf("err = %v, want the FCM error code through errors.As", err)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+)
+
+// signFunc signs the JWT signing input and returns the raw signature
+type signFunc func(signingInput []byte) ([]byte, error)
+
+// encodeJWT builds a compact JWS from the given header and claims
+func encodeJWT(header, claims interface{}, sign signFunc) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal jwt header: %w", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal jwt claims: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	sig, err := sign([]byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign jwt: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// rs256Signer signs with RSASSA-PKCS1-v1_5 using SHA-256
+func rs256Signer(key *rsa.PrivateKey) signFunc {
+	return func(signingInput []byte) ([]byte, error) {
+		digest := sha256.Sum256(signingInput)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+}
+
+// es256Signer signs with ECDSA P-256 using SHA-256, encoding the signature as raw r||s
+func es256Signer(key *ecdsa.PrivateKey) signFunc {
+	return func(signingInput []byte) ([]byte, error) {
+		digest := sha256.Sum256(signingInput)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	}
+}
+
+// parsePKCS8PrivateKey decodes a PEM encoded PKCS#8 private key
+func parsePKCS8PrivateKey(pemData []byte) (interface{}, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return key, nil
+}
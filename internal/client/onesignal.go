@@ -6,17 +6,25 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/whotterre/push_microservice/internal/apperrors"
 	"github.com/whotterre/push_microservice/internal/config"
 )
 
 type OneSignalClient struct {
-	cfg *config.Config
+	cfg        *config.Config
+	httpClient *http.Client
 }
 
 func NewOneSignalClient(cfg *config.Config) *OneSignalClient {
 	return &OneSignalClient{
-		cfg: cfg,
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
 	}
 }
 
@@ -25,9 +33,43 @@ type OneSignalNotification struct {
 	IncludePlayerIDs   []string               `json:"include_player_ids,omitempty"`
 	IncludeExternalIDs []string               `json:"include_external_user_ids,omitempty"` // Your own user IDs
 	IncludeSegments    []string               `json:"included_segments,omitempty"`
-	Contents           map[string]string      `json:"contents"`
+	Contents           map[string]string      `json:"contents,omitempty"`
 	Headings           map[string]string      `json:"headings,omitempty"`
 	Data               map[string]interface{} `json:"data,omitempty"`
+	ExternalID         string                 `json:"external_id,omitempty"`       // idempotency key, OneSignal drops repeats for 30 days
+	ContentAvailable   bool                   `json:"content_available,omitempty"` // silent push: wakes the app, nothing is shown
+
+	// Delivery options
+	Priority             int    `json:"priority,omitempty"`               // 10 high, 5 normal
+	IOSInterruptionLevel string `json:"ios_interruption_level,omitempty"` // active, passive, time_sensitive, critical
+	TTL                  *int   `json:"ttl,omitempty"`                    // seconds, 0 means deliver now or never
+	CollapseID           string `json:"collapse_id,omitempty"`
+	WebPushTopic         string `json:"web_push_topic,omitempty"`
+
+	// Rich content
+	BigPicture       string            `json:"big_picture,omitempty"`      // Android
+	ChromeWebImage   string            `json:"chrome_web_image,omitempty"` // web
+	IOSAttachments   map[string]string `json:"ios_attachments,omitempty"`
+	URL              string            `json:"url,omitempty"` // every platform
+	AppURL           string            `json:"app_url,omitempty"`
+	WebURL           string            `json:"web_url,omitempty"`
+	Buttons          []OneSignalButton `json:"buttons,omitempty"`     // mobile
+	WebButtons       []OneSignalButton `json:"web_buttons,omitempty"` // web
+	IOSSound         string            `json:"ios_sound,omitempty"`
+	AndroidSound     string            `json:"android_sound,omitempty"` // file name without extension
+	IOSBadgeType     string            `json:"ios_badgeType,omitempty"`
+	IOSBadgeCount    int               `json:"ios_badgeCount,omitempty"`
+	AndroidChannelID string            `json:"android_channel_id,omitempty"`
+	ThreadID         string            `json:"thread_id,omitempty"` // iOS
+	AndroidGroup     string            `json:"android_group,omitempty"`
+}
+
+// OneSignalButton is an action button; URL is only used by web buttons
+type OneSignalButton struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	Icon string `json:"icon,omitempty"`
+	URL  string `json:"url,omitempty"`
 }
 
 type OneSignalResponse struct {
@@ -81,9 +123,9 @@ func (c *OneSignalClient) SendPushNotification(notification *OneSignalNotificati
 	req.Header.Add("Authorization", "Basic "+c.cfg.OneSignalKey)
 	req.Header.Add("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, requestError(err)
 	}
 	defer res.Body.Close()
 
@@ -93,7 +135,7 @@ func (c *OneSignalClient) SendPushNotification(notification *OneSignalNotificati
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return nil, fmt.Errorf("onesignal API error (status %d): %s", res.StatusCode, string(body))
+		return nil, newAPIError(ProviderOneSignal, res, body)
 	}
 
 	var oneSignalRes OneSignalResponse
@@ -138,20 +180,264 @@ func (c *OneSignalClient) SendToExternalUserIDs(externalUserIDs []string, title,
 	return c.SendPushNotification(notification)
 }
 
-func (c *OneSignalClient) SendToSegment(segment, title, message string, data map[string]interface{}) (*OneSignalResponse, error) {
+// newNotification fills the content shared by every OneSignal send
+func (c *OneSignalClient) newNotification(msg *PushMessage) *OneSignalNotification {
 	notification := &OneSignalNotification{
-		AppID:           c.cfg.OneSignalAppID,
-		IncludeSegments: []string{segment},
-		Contents: map[string]string{
-			"en": message,
-		},
-		Headings: map[string]string{
-			"en": title,
-		},
-		Data: data,
+		AppID: c.cfg.OneSignalAppID,
+		Data:  msg.Data,
+	}
+	// OneSignal only accepts a UUID as external_id
+	if _, err := uuid.Parse(msg.ExternalID); err == nil {
+		notification.ExternalID = msg.ExternalID
 	}
+	applyOneSignalDeliveryOptions(notification, msg)
+	// A data-only notification must not have contents, or OneSignal displays it
+	if msg.Silent() {
+		notification.ContentAvailable = true
+		return notification
+	}
+	notification.Contents = oneSignalLanguages(msg.Message, msg.Messages)
+	notification.Headings = oneSignalLanguages(msg.Title, msg.Titles)
+	applyOneSignalRichContent(notification, msg)
+	return notification
+}
 
-	return c.SendPushNotification(notification)
+// applyOneSignalDeliveryOptions maps priority, time to live and collapse ID. A high
+// priority notification is time sensitive on iOS, breaking through Focus modes.
+func applyOneSignalDeliveryOptions(notification *OneSignalNotification, msg *PushMessage) {
+	switch msg.Priority {
+	case "high":
+		notification.Priority = 10
+		if !msg.Silent() {
+			notification.IOSInterruptionLevel = "time_sensitive"
+		}
+	case "normal":
+		notification.Priority = 5
+		if !msg.Silent() {
+			notification.IOSInterruptionLevel = "active"
+		}
+	}
+	if msg.TTL != nil {
+		ttl := int(msg.TTL.Seconds())
+		notification.TTL = &ttl
+	}
+	notification.CollapseID = msg.CollapseID
+	notification.WebPushTopic = msg.CollapseID
+}
+
+// applyOneSignalRichContent maps images, links, buttons, sound, badge and grouping onto
+// OneSignal's per-platform fields
+func applyOneSignalRichContent(notification *OneSignalNotification, msg *PushMessage) {
+	if msg.ImageURL != "" {
+		notification.BigPicture = msg.ImageURL
+		notification.ChromeWebImage = msg.ImageURL
+		notification.IOSAttachments = map[string]string{"image": msg.ImageURL}
+	}
+
+	// url applies to every platform; app_url and web_url split it when both are given
+	switch {
+	case msg.DeepLink != "" && msg.URL != "":
+		notification.AppURL = msg.DeepLink
+		notification.WebURL = msg.URL
+	case msg.DeepLink != "":
+		notification.AppURL = msg.DeepLink
+	case msg.URL != "":
+		notification.URL = msg.URL
+	}
+
+	for _, button := range msg.Buttons {
+		notification.Buttons = append(notification.Buttons, OneSignalButton{ID: button.ID, Text: button.Text, Icon: button.Icon})
+		notification.WebButtons = append(notification.WebButtons, OneSignalButton{ID: button.ID, Text: button.Text, Icon: button.Icon, URL: button.URL})
+	}
+
+	if msg.Sound != "" {
+		notification.IOSSound = msg.Sound
+		notification.AndroidSound = strings.TrimSuffix(msg.Sound, path.Ext(msg.Sound))
+	}
+	if msg.BadgeIncrement != 0 {
+		notification.IOSBadgeType = "Increase"
+		notification.IOSBadgeCount = msg.BadgeIncrement
+	}
+	notification.AndroidChannelID = msg.AndroidChannelID
+	notification.ThreadID = msg.Group
+	notification.AndroidGroup = msg.Group
+}
+
+// oneSignalLanguages builds a contents/headings map. OneSignal picks the language per
+// subscriber itself and requires "en", which gets the default text unless given.
+// A regional tag such as pt-BR is sent as its language, pt, unless pt is given as well.
+func oneSignalLanguages(fallback string, localized map[string]string) map[string]string {
+	languages := map[string]string{"en": fallback}
+	tags := make([]string, 0, len(localized))
+	for tag := range localized {
+		tags = append(tags, tag)
+	}
+	// Longer tags first so an exact language overwrites a regional variant
+	sort.Slice(tags, func(i, j int) bool {
+		if len(tags[i]) != len(tags[j]) {
+			return len(tags[i]) > len(tags[j])
+		}
+		return tags[i] < tags[j]
+	})
+	for _, tag := range tags {
+		languages[oneSignalLanguage(tag)] = localized[tag]
+	}
+	return languages
+}
+
+// oneSignalLanguage maps a language tag onto OneSignal's language codes
+func oneSignalLanguage(tag string) string {
+	tag = strings.ReplaceAll(tag, "_", "-")
+	switch strings.ToLower(tag) {
+	case "zh-hans", "zh-cn", "zh-sg":
+		return "zh-Hans"
+	case "zh-hant", "zh-tw", "zh-hk":
+		return "zh-Hant"
+	}
+	language, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(language)
+}
+
+// Name returns the provider identifier
+func (c *OneSignalClient) Name() string {
+	return ProviderOneSignal
+}
+
+// Capabilities reports what OneSignal supports
+func (c *OneSignalClient) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Platforms:     []string{"web", "ios", "android"},
+		Segments:      true,
+		DeviceListing: true,
+		MaxBatchSize:  2000, // OneSignal include_player_ids limit
+	}
+}
+
+// SendToDevices sends a notification to the given OneSignal players
+func (c *OneSignalClient) SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error) {
+	playerIDs := make([]string, 0, len(devices))
+	for _, device := range devices {
+		playerIDs = append(playerIDs, device.Token)
+	}
+
+	notification := c.newNotification(msg)
+	notification.IncludePlayerIDs = playerIDs
+
+	res, err := c.SendPushNotification(notification)
+	if err != nil {
+		return nil, err
+	}
+	return res.toSendResult(), res.rejection()
+}
+
+// SendToSegment sends a notification to every subscriber of a OneSignal segment
+func (c *OneSignalClient) SendToSegment(segment string, msg *PushMessage) (*SendResult, error) {
+	notification := c.newNotification(msg)
+	notification.IncludeSegments = []string{segment}
+
+	res, err := c.SendPushNotification(notification)
+	if err != nil {
+		return nil, err
+	}
+	return res.toSendResult(), res.rejection()
+}
+
+// ListDevices fetches the players subscribed to the app
+func (c *OneSignalClient) ListDevices(limit, offset int) (*PlayersResponse, error) {
+	return c.GetPlayers(limit, offset)
+}
+
+// rejection returns a permanent error when OneSignal accepted the request but created
+// no notification, e.g. every player was unsubscribed. Retrying would get the same answer.
+func (r *OneSignalResponse) rejection() error {
+	errs := r.GetErrors()
+	if r.ID != "" || len(errs) == 0 {
+		return nil
+	}
+	return apperrors.Permanent(fmt.Errorf("onesignal created no notification: %s", strings.Join(errs, "; ")))
+}
+
+func (r *OneSignalResponse) toSendResult() *SendResult {
+	result := &SendResult{
+		Provider:   ProviderOneSignal,
+		ID:         r.ID,
+		Recipients: r.Recipients,
+		Errors:     r.GetErrors(),
+	}
+
+	// OneSignal reports players it no longer recognises as {"invalid_player_ids": [...]}
+	if errMap, ok := r.Errors.(map[string]interface{}); ok {
+		if invalid, ok := errMap["invalid_player_ids"].([]interface{}); ok {
+			for _, id := range invalid {
+				if playerID, ok := id.(string); ok {
+					result.Results = append(result.Results, DeviceResult{
+						Token:        playerID,
+						ErrorCode:    "invalid_player_id",
+						Error:        "invalid player id",
+						Unregistered: true,
+					})
+				}
+			}
+		}
+	}
+	return result
+}
+
+// NotificationReport is the outcome of a sent notification as reported by the provider
+type NotificationReport struct {
+	ID          string `json:"id"`
+	Successful  int    `json:"successful"` // handed to the platform push service
+	Failed      int    `json:"failed"`     // unsubscribed or unreachable devices
+	Errored     int    `json:"errored"`    // errors on the provider side
+	Converted   int    `json:"converted"`  // clicked
+	Remaining   int    `json:"remaining"`  // still to be sent
+	Canceled    bool   `json:"canceled"`
+	CompletedAt *int64 `json:"completed_at"` // unix seconds, nil while sending
+}
+
+// Done reports whether the provider has finished sending the notification
+func (r *NotificationReport) Done() bool {
+	return r.CompletedAt != nil || r.Canceled || (r.Remaining == 0 && r.Successful+r.Failed+r.Errored > 0)
+}
+
+// NotificationReporter is implemented by providers that report delivery outcomes after a send
+type NotificationReporter interface {
+	NotificationReport(id string) (*NotificationReport, error)
+}
+
+// NotificationReport fetches the outcome of a notification from the View notification API
+func (c *OneSignalClient) NotificationReport(id string) (*NotificationReport, error) {
+	apiUrl := fmt.Sprintf("https://api.onesignal.com/notifications/%s?app_id=%s", id, c.cfg.OneSignalAppID)
+
+	req, err := http.NewRequest("GET", apiUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Add("Authorization", "Basic "+c.cfg.OneSignalKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, requestError(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, newAPIError(ProviderOneSignal, res, body)
+	}
+
+	var report NotificationReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &report, nil
 }
 
 // Player represents a OneSignal device/player
@@ -188,12 +474,12 @@ func (c *OneSignalClient) GetPlayers(limit, offset int) (*PlayersResponse, error
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Add("Authorization", "Basic " + c.cfg.OneSignalKey)
+	req.Header.Add("Authorization", "Basic "+c.cfg.OneSignalKey)
 	req.Header.Add("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, requestError(err)
 	}
 	defer res.Body.Close()
 
@@ -203,7 +489,7 @@ func (c *OneSignalClient) GetPlayers(limit, offset int) (*PlayersResponse, error
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return nil, fmt.Errorf("onesignal API error (status %d): %s", res.StatusCode, string(body))
+		return nil, newAPIError(ProviderOneSignal, res, body)
 	}
 
 	var playersRes PlayersResponse
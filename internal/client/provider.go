@@ -0,0 +1,192 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+const (
+	ProviderOneSignal = "onesignal"
+)
+
+// PushProvider is implemented by every push delivery backend
+type PushProvider interface {
+	Name() string
+	Capabilities() ProviderCapabilities
+	SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error)
+	SendToSegment(segment string, msg *PushMessage) (*SendResult, error)
+	ListDevices(limit, offset int) (*PlayersResponse, error)
+}
+
+// ProviderCapabilities describes what a provider is able to do
+type ProviderCapabilities struct {
+	Platforms     []string // platforms the provider can deliver to: web, ios, android
+	Segments      bool     // supports SendToSegment
+	DeviceListing bool     // supports ListDevices
+	MaxBatchSize  int      // max devices per SendToDevices call, 0 means unlimited
+}
+
+// SupportsPlatform reports whether the provider can deliver to the given platform
+func (c ProviderCapabilities) SupportsPlatform(platform string) bool {
+	for _, p := range c.Platforms {
+		if strings.EqualFold(p, platform) {
+			return true
+		}
+	}
+	return false
+}
+
+// Device is a single delivery target as seen by a provider
+type Device struct {
+	Token     string            // address for the provider being called (OneSignal player ID, FCM token, ...)
+	Addresses map[string]string // provider name -> token, used by the Router to fill Token
+	Platform  string
+	Locale    string               // language key of PushMessage.Titles/Messages to use, empty for the default content
+	WebPush   *WebPushSubscription // set for browsers subscribed through standard Web Push
+}
+
+// PushMessage is the provider-agnostic content of a notification
+type PushMessage struct {
+	Title      string
+	Message    string
+	Data       map[string]interface{}
+	ExternalID string // our notification ID, passed to providers that deduplicate on it
+
+	// Localized content by language tag, e.g. pt-BR. Title and Message are the default.
+	Titles   map[string]string
+	Messages map[string]string
+
+	// Rich content, honoured by providers that support it
+	ImageURL         string
+	URL              string // web page opened on click
+	DeepLink         string // app URL opened on click
+	Buttons          []Button
+	Sound            string
+	BadgeIncrement   int
+	AndroidChannelID string
+	Group            string // iOS thread ID / Android group key
+
+	// Delivery options, honoured by providers that support them
+	Priority   string         // "high" | "normal"
+	TTL        *time.Duration // how long the provider keeps trying: nil means its default, 0 means now or never
+	CollapseID string
+	PushType   string // alert, or background for a silent data-only push
+}
+
+// Button is an action button shown with a notification
+type Button struct {
+	ID   string
+	Text string
+	Icon string
+	URL  string // web buttons only
+}
+
+// Silent reports whether the message is a data-only background push, sent without
+// any title, body or rich content
+func (m *PushMessage) Silent() bool {
+	return m.PushType == APNsPushTypeBackground
+}
+
+// ForLocale returns the message with its title and body in the given language,
+// or the message itself when it has no content for that language
+func (m *PushMessage) ForLocale(locale string) *PushMessage {
+	title, hasTitle := m.Titles[locale]
+	body, hasBody := m.Messages[locale]
+	if locale == "" || !hasTitle && !hasBody {
+		return m
+	}
+	localized := *m
+	if hasTitle {
+		localized.Title = title
+	}
+	if hasBody {
+		localized.Message = body
+	}
+	return &localized
+}
+
+// SendResult is the provider-agnostic outcome of a send
+type SendResult struct {
+	Provider   string            `json:"provider"` // provider(s) that delivered, comma separated when routed
+	ID         string            `json:"id"`
+	Recipients int               `json:"recipients"`
+	Errors     []string          `json:"errors,omitempty"`
+	Results    []DeviceResult    `json:"results,omitempty"`  // per-device outcomes, when the provider reports them
+	Attempts   []ProviderAttempt `json:"attempts,omitempty"` // provider calls made by the Router
+}
+
+// DeviceResult is the outcome of a send to a single device
+type DeviceResult struct {
+	Provider     string `json:"provider,omitempty"`
+	Token        string `json:"token"`
+	MessageID    string `json:"message_id,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Unregistered bool   `json:"unregistered,omitempty"` // token is no longer valid and the device should be deactivated
+	Transient    bool   `json:"transient,omitempty"`    // the failure is worth retrying through the next provider
+}
+
+// UnregisteredTokens returns the tokens reported as no longer valid, grouped by provider
+func (r *SendResult) UnregisteredTokens() map[string][]string {
+	tokens := make(map[string][]string)
+	for _, result := range r.Results {
+		if !result.Unregistered {
+			continue
+		}
+		provider := result.Provider
+		if provider == "" {
+			provider = r.Provider
+		}
+		tokens[provider] = append(tokens[provider], result.Token)
+	}
+	return tokens
+}
+
+// NewPushProvider builds a Router over the providers named in cfg.PushRoutes,
+// falling back to cfg.PushProvider for every platform when no routes are set
+func NewPushProvider(cfg *config.Config) (PushProvider, error) {
+	fallback := cfg.PushProvider
+	if fallback == "" {
+		fallback = ProviderOneSignal
+	}
+
+	routes, err := ParseRoutes(cfg.PushRoutes, fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := make(map[string]PushProvider)
+	for _, chain := range routes {
+		for _, name := range chain {
+			if _, ok := providers[name]; ok {
+				continue
+			}
+			provider, err := newProvider(name, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create %s provider: %w", name, err)
+			}
+			providers[name] = provider
+		}
+	}
+
+	return NewRouter(providers, routes)
+}
+
+// newProvider builds a single provider by name
+func newProvider(name string, cfg *config.Config) (PushProvider, error) {
+	switch name {
+	case ProviderOneSignal:
+		return NewOneSignalClient(cfg), nil
+	case ProviderFCM:
+		return NewFCMClient(cfg)
+	case ProviderAPNs:
+		return NewAPNsClient(cfg)
+	case ProviderWebPush:
+		return NewWebPushClient(cfg)
+	default:
+		return nil, fmt.Errorf("unknown push provider: %s", name)
+	}
+}
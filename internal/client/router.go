@@ -0,0 +1,334 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/whotterre/push_microservice/internal/apperrors"
+)
+
+const (
+	ProviderRouter = "router"
+
+	// routeDefault is the rule used for platforms without an explicit route
+	routeDefault = "*"
+)
+
+// ErrNoRoute is returned when no configured provider holds an address for any of the devices
+var ErrNoRoute = errors.New("no configured provider can reach the devices")
+
+// ProviderAttempt records one call to a provider made while routing a send
+type ProviderAttempt struct {
+	Provider   string        `json:"provider"`
+	Devices    int           `json:"devices"`
+	Recipients int           `json:"recipients"`
+	Fallback   bool          `json:"fallback"` // the devices were failed over from another provider
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Router picks a provider per device platform and fails over to the next
+// provider in the platform's chain when the current one is unavailable
+type Router struct {
+	providers map[string]PushProvider
+	routes    map[string][]string // platform -> ordered provider names
+}
+
+func NewRouter(providers map[string]PushProvider, routes map[string][]string) (*Router, error) {
+	for platform, chain := range routes {
+		for _, name := range chain {
+			if _, ok := providers[name]; !ok {
+				return nil, fmt.Errorf("route %s references unconfigured provider %s", platform, name)
+			}
+		}
+	}
+	return &Router{providers: providers, routes: routes}, nil
+}
+
+// ParseRoutes parses a PUSH_ROUTES spec such as
+// "ios=apns,onesignal;android=fcm,onesignal;web=webpush,onesignal".
+// Platforms without a rule use the "*" rule, which defaults to fallback.
+func ParseRoutes(spec, fallback string) (map[string][]string, error) {
+	routes := make(map[string][]string)
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		platform, chain, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route %q: expected platform=provider[,provider...]", rule)
+		}
+		platform = strings.ToLower(strings.TrimSpace(platform))
+		for _, name := range strings.Split(chain, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				routes[platform] = append(routes[platform], name)
+			}
+		}
+		if len(routes[platform]) == 0 {
+			return nil, fmt.Errorf("invalid route %q: no providers", rule)
+		}
+	}
+	if _, ok := routes[routeDefault]; !ok && fallback != "" {
+		routes[routeDefault] = []string{strings.ToLower(fallback)}
+	}
+	return routes, nil
+}
+
+// Name returns the provider identifier
+func (r *Router) Name() string {
+	return ProviderRouter
+}
+
+// Capabilities is the union of every routed provider's capabilities
+func (r *Router) Capabilities() ProviderCapabilities {
+	var caps ProviderCapabilities
+	for _, provider := range r.providers {
+		pc := provider.Capabilities()
+		for _, platform := range pc.Platforms {
+			if !caps.SupportsPlatform(platform) {
+				caps.Platforms = append(caps.Platforms, platform)
+			}
+		}
+		caps.Segments = caps.Segments || pc.Segments
+		caps.DeviceListing = caps.DeviceListing || pc.DeviceListing
+	}
+	return caps
+}
+
+// routedDevice tracks where a device is in its platform's provider chain
+type routedDevice struct {
+	device     Device
+	candidates []string // providers in the chain that hold an address for the device
+	next       int
+}
+
+// SendToDevices delivers to each device through the first provider in its
+// platform's chain, in batches no larger than the provider's MaxBatchSize. A device
+// that fails with a transient error moves on to the next provider in its chain.
+func (r *Router) SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error) {
+	pending := make([]*routedDevice, 0, len(devices))
+	for _, device := range devices {
+		rd := &routedDevice{device: device}
+		for _, name := range r.chainFor(device.Platform) {
+			if device.Addresses[name] != "" {
+				rd.candidates = append(rd.candidates, name)
+			}
+		}
+		if len(rd.candidates) > 0 {
+			pending = append(pending, rd)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, ErrNoRoute
+	}
+
+	res := &SendResult{Provider: ProviderRouter}
+	delivered := make([]string, 0)
+	var lastErr error
+
+	for round := 0; len(pending) > 0; round++ {
+		batches := make(map[string][]*routedDevice)
+		for _, rd := range pending {
+			name := rd.candidates[rd.next]
+			batches[name] = append(batches[name], rd)
+		}
+		pending = pending[:0:0]
+
+		for _, name := range sortedKeys(batches) {
+			split := splitBatch(batches[name], r.providers[name].Capabilities().MaxBatchSize)
+			for i, batch := range split {
+				targets := make([]Device, 0, len(batch))
+				for _, rd := range batch {
+					target := rd.device
+					target.Token = rd.device.Addresses[name]
+					targets = append(targets, target)
+				}
+
+				providerMsg := msg
+				if round > 0 || len(split) > 1 {
+					providerMsg = batchMessage(msg, name, round, i)
+				}
+
+				start := time.Now()
+				providerRes, err := r.providers[name].SendToDevices(targets, providerMsg)
+				attempt := ProviderAttempt{
+					Provider: name,
+					Devices:  len(targets),
+					Fallback: round > 0,
+					Duration: time.Since(start),
+				}
+
+				if providerRes != nil {
+					attempt.Recipients = providerRes.Recipients
+					res.Recipients += providerRes.Recipients
+					res.Errors = append(res.Errors, providerRes.Errors...)
+					if res.ID == "" && providerRes.Recipients > 0 {
+						res.ID = providerRes.ID
+					}
+					if providerRes.Recipients > 0 && !containsString(delivered, name) {
+						delivered = append(delivered, name)
+					}
+				}
+
+				// Devices that failed transiently move on to the next provider in their chain,
+				// whether the whole call failed or only some devices in it
+				for i, result := range deviceResults(targets, providerRes, err) {
+					result.Provider = name
+					res.Results = append(res.Results, result)
+					rd := batch[i]
+					if result.Error != "" && result.Transient && rd.next+1 < len(rd.candidates) {
+						rd.next++
+						pending = append(pending, rd)
+					}
+				}
+
+				if err != nil {
+					attempt.Error = err.Error()
+					lastErr = err
+				}
+				res.Attempts = append(res.Attempts, attempt)
+			}
+		}
+	}
+
+	if len(delivered) > 0 {
+		res.Provider = strings.Join(delivered, ",")
+	}
+	if res.Recipients == 0 && lastErr != nil {
+		return res, lastErr
+	}
+	return res, nil
+}
+
+// SendToSegment uses the first provider in the default chain that supports segments
+func (r *Router) SendToSegment(segment string, msg *PushMessage) (*SendResult, error) {
+	for _, name := range r.routes[routeDefault] {
+		provider := r.providers[name]
+		if provider.Capabilities().Segments {
+			return provider.SendToSegment(segment, msg)
+		}
+	}
+	return nil, fmt.Errorf("no routed provider supports segments")
+}
+
+// ListDevices uses the first provider in the default chain that supports device listing
+func (r *Router) ListDevices(limit, offset int) (*PlayersResponse, error) {
+	for _, name := range r.routes[routeDefault] {
+		provider := r.providers[name]
+		if provider.Capabilities().DeviceListing {
+			return provider.ListDevices(limit, offset)
+		}
+	}
+	return nil, fmt.Errorf("no routed provider supports device listing")
+}
+
+// Reporter returns the named provider if it is routed and reports delivery outcomes
+func (r *Router) Reporter(name string) (NotificationReporter, bool) {
+	reporter, ok := r.providers[name].(NotificationReporter)
+	return reporter, ok
+}
+
+func (r *Router) chainFor(platform string) []string {
+	if chain, ok := r.routes[strings.ToLower(platform)]; ok {
+		return chain
+	}
+	return r.routes[routeDefault]
+}
+
+// IsTransientError reports whether a provider error is worth failing over to the
+// next provider: a 5xx response, throttling, or a transport failure
+func IsTransientError(err error) bool {
+	if errors.Is(err, apperrors.ErrProviderTransient) || errors.Is(err, apperrors.ErrRateLimited) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// deviceResults returns one result per target. Providers only report some devices
+// individually (OneSignal lists just the invalid ones), so the rest take the
+// outcome of the call as a whole.
+func deviceResults(targets []Device, res *SendResult, err error) []DeviceResult {
+	reported := make(map[string]DeviceResult)
+	if res != nil {
+		for _, result := range res.Results {
+			reported[result.Token] = result
+		}
+	}
+
+	results := make([]DeviceResult, 0, len(targets))
+	for _, target := range targets {
+		if result, ok := reported[target.Token]; ok {
+			results = append(results, result)
+			continue
+		}
+		result := DeviceResult{Token: target.Token}
+		if err != nil {
+			result.Error = err.Error()
+			result.Transient = IsTransientError(err)
+			var apiErr *APIError
+			if errors.As(err, &apiErr) {
+				result.ErrorCode = apiErr.Code
+			}
+		} else if res != nil {
+			result.MessageID = res.ID
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// batchMessage returns msg with an external ID of its own for one of several calls to
+// provider. Providers deduplicate on the external ID, so calls sharing one would be
+// dropped as repeats of the first. The ID is derived from the notification's rather
+// than random so a retry of the send reuses it.
+func batchMessage(msg *PushMessage, provider string, round, batch int) *PushMessage {
+	if msg.ExternalID == "" {
+		return msg
+	}
+	copied := *msg
+	name := fmt.Sprintf("%s/%s/%d/%d", msg.ExternalID, provider, round, batch)
+	copied.ExternalID = uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+	return &copied
+}
+
+// splitBatch cuts devices into batches of at most size, or returns them as one batch when size is 0
+func splitBatch(devices []*routedDevice, size int) [][]*routedDevice {
+	if size <= 0 || len(devices) <= size {
+		return [][]*routedDevice{devices}
+	}
+	batches := make([][]*routedDevice, 0, (len(devices)+size-1)/size)
+	for start := 0; start < len(devices); start += size {
+		batches = append(batches, devices[start:min(start+size, len(devices))])
+	}
+	return batches
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string][]*routedDevice) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
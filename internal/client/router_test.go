@@ -0,0 +1,151 @@
+package client
+
+import (
+	"slices"
+	"testing"
+)
+
+// stubProvider records the batches it is sent and fails the tokens listed in failTokens
+type stubProvider struct {
+	name        string
+	maxBatch    int
+	failTokens  map[string]error
+	batches     [][]string
+	externalIDs []string
+}
+
+func (p *stubProvider) Name() string { return p.name }
+
+func (p *stubProvider) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{Platforms: []string{"android"}, MaxBatchSize: p.maxBatch}
+}
+
+func (p *stubProvider) SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error) {
+	var tokens []string
+	res := &SendResult{ID: p.name + "-id"}
+	for _, d := range devices {
+		tokens = append(tokens, d.Token)
+		result := DeviceResult{Token: d.Token}
+		if err, ok := p.failTokens[d.Token]; ok {
+			result.Error = err.Error()
+			result.Transient = IsTransientError(err)
+		} else {
+			result.MessageID = p.name + "-" + d.Token
+			res.Recipients++
+		}
+		res.Results = append(res.Results, result)
+	}
+	p.batches = append(p.batches, tokens)
+	p.externalIDs = append(p.externalIDs, msg.ExternalID)
+	return res, nil
+}
+
+func (p *stubProvider) SendToSegment(segment string, msg *PushMessage) (*SendResult, error) {
+	return nil, nil
+}
+
+func (p *stubProvider) ListDevices(limit, offset int) (*PlayersResponse, error) {
+	return nil, nil
+}
+
+func androidDevice(token string) Device {
+	return Device{
+		Platform:  "android",
+		Addresses: map[string]string{ProviderFCM: "fcm-" + token, ProviderOneSignal: "os-" + token},
+	}
+}
+
+func TestRouterSplitsBatchesByProviderLimit(t *testing.T) {
+	fcm := &stubProvider{name: ProviderFCM, maxBatch: 2}
+	router, err := NewRouter(map[string]PushProvider{ProviderFCM: fcm}, map[string][]string{"android": {ProviderFCM}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices := []Device{androidDevice("a"), androidDevice("b"), androidDevice("c"), androidDevice("d"), androidDevice("e")}
+	res, err := router.SendToDevices(devices, &PushMessage{Title: "hi"})
+	if err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	if res.Recipients != 5 {
+		t.Errorf("recipients = %d, want 5", res.Recipients)
+	}
+	if len(fcm.batches) != 3 {
+		t.Fatalf("batches = %v, want 3 batches", fcm.batches)
+	}
+	for i, want := range []int{2, 2, 1} {
+		if len(fcm.batches[i]) != want {
+			t.Errorf("batch %d has %d devices, want %d", i, len(fcm.batches[i]), want)
+		}
+	}
+	if len(res.Attempts) != 3 {
+		t.Errorf("attempts = %d, want 3", len(res.Attempts))
+	}
+}
+
+func TestRouterFailsOverOnlyTransientDeviceFailures(t *testing.T) {
+	fcm := &stubProvider{
+		name: ProviderFCM,
+		failTokens: map[string]error{
+			"fcm-b": &APIError{Provider: ProviderFCM, StatusCode: 503, Message: "unavailable"},
+			"fcm-c": &APIError{Provider: ProviderFCM, StatusCode: 400, Message: "invalid registration"},
+		},
+	}
+	onesignal := &stubProvider{name: ProviderOneSignal}
+	router, err := NewRouter(
+		map[string]PushProvider{ProviderFCM: fcm, ProviderOneSignal: onesignal},
+		map[string][]string{"android": {ProviderFCM, ProviderOneSignal}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := router.SendToDevices([]Device{androidDevice("a"), androidDevice("b"), androidDevice("c")}, &PushMessage{Title: "hi"})
+	if err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	if len(onesignal.batches) != 1 || len(onesignal.batches[0]) != 1 || onesignal.batches[0][0] != "os-b" {
+		t.Fatalf("onesignal batches = %v, want only os-b", onesignal.batches)
+	}
+	if res.Recipients != 2 {
+		t.Errorf("recipients = %d, want 2", res.Recipients)
+	}
+	if len(res.Attempts) != 2 || !res.Attempts[1].Fallback {
+		t.Errorf("attempts = %+v, want a fallback attempt", res.Attempts)
+	}
+}
+
+func TestRouterGivesEachProviderCallItsOwnExternalID(t *testing.T) {
+	const notificationID = "5f1d3c0e-8a51-4b8e-9c3b-2f0d6f1e7a42"
+	send := func(devices ...Device) *stubProvider {
+		t.Helper()
+		onesignal := &stubProvider{name: ProviderOneSignal, maxBatch: 2}
+		router, err := NewRouter(map[string]PushProvider{ProviderOneSignal: onesignal}, map[string][]string{"android": {ProviderOneSignal}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := router.SendToDevices(devices, &PushMessage{Title: "hi", ExternalID: notificationID}); err != nil {
+			t.Fatalf("SendToDevices: %v", err)
+		}
+		return onesignal
+	}
+
+	// One call keeps the notification's ID
+	if ids := send(androidDevice("a")).externalIDs; len(ids) != 1 || ids[0] != notificationID {
+		t.Errorf("external ids = %v, want the notification ID", ids)
+	}
+
+	// Batches sharing an ID would be dropped by OneSignal as repeats of the first
+	devices := []Device{androidDevice("a"), androidDevice("b"), androidDevice("c"), androidDevice("d"), androidDevice("e")}
+	ids := send(devices...).externalIDs
+	seen := map[string]bool{notificationID: true}
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("external ids = %v, want each batch its own", ids)
+		}
+		seen[id] = true
+	}
+	if again := send(devices...).externalIDs; !slices.Equal(again, ids) {
+		t.Errorf("retry external ids = %v, want the same %v", again, ids)
+	}
+}
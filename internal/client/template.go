@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+const templateServiceName = "template-service"
+
+// Template is a notification template as stored by the template service
+type Template struct {
+	TemplateID string   `json:"template_id"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"` // email, push
+	Subject    string   `json:"subject"`
+	Content    string   `json:"content"`
+	Variables  []string `json:"variables"`
+	Language   string   `json:"language"`
+	Version    int      `json:"version"`
+	Active     bool     `json:"active"`
+}
+
+// RenderedTemplate is a template with its variables substituted
+type RenderedTemplate struct {
+	Subject          string   `json:"subject"`
+	Content          string   `json:"content"`
+	VariablesUsed    []string `json:"variables_used,omitempty"`
+	VariablesMissing []string `json:"variables_missing,omitempty"`
+}
+
+// templateEnvelope is the response wrapper every template service endpoint uses
+type templateEnvelope struct {
+	Success bool            `json:"success"`
+	Data    json.RawMessage `json:"data"`
+	Message string          `json:"message"`
+}
+
+// TemplateClient calls the template service (specs/template.yaml)
+type TemplateClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewTemplateClient(cfg *config.Config) *TemplateClient {
+	return &TemplateClient{
+		baseURL:    strings.TrimRight(cfg.TemplateServiceURL, "/"),
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// GetTemplate fetches a template, including its current version
+func (c *TemplateClient) GetTemplate(templateID string) (*Template, error) {
+	apiUrl := fmt.Sprintf("%s/templates/%s", c.baseURL, url.PathEscape(templateID))
+
+	var template Template
+	if err := c.do("GET", apiUrl, nil, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// RenderTemplate substitutes variables into a template in the given language
+func (c *TemplateClient) RenderTemplate(templateID, language string, variables map[string]string) (*RenderedTemplate, error) {
+	apiUrl := fmt.Sprintf("%s/templates/%s/render", c.baseURL, url.PathEscape(templateID))
+	if language != "" {
+		apiUrl += "?language=" + url.QueryEscape(language)
+	}
+
+	if variables == nil {
+		variables = map[string]string{}
+	}
+	payload, err := json.Marshal(map[string]interface{}{"variables": variables})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal render request: %w", err)
+	}
+
+	var rendered RenderedTemplate
+	if err := c.do("POST", apiUrl, payload, &rendered); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+// do sends a request and unwraps the data of the response envelope into out
+func (c *TemplateClient) do(method, apiUrl string, payload []byte, out interface{}) error {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewBuffer(payload)
+	}
+	req, err := http.NewRequest(method, apiUrl, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return requestError(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		apiErr := newAPIError(templateServiceName, res, body)
+		var envelope templateEnvelope
+		if json.Unmarshal(body, &envelope) == nil && envelope.Message != "" {
+			apiErr.Message = envelope.Message
+		}
+		return apiErr
+	}
+
+	var envelope templateEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if err := json.Unmarshal(envelope.Data, out); err != nil {
+		return fmt.Errorf("failed to parse response data: %w", err)
+	}
+	return nil
+}
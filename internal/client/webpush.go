@@ -0,0 +1,382 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+const (
+	ProviderWebPush = "webpush"
+
+	webPushRecordSize     = 4096
+	webPushHeaderSize     = 86 // salt, record size, key id length and the 65 byte key id
+	webPushMaxPayload     = webPushRecordSize - webPushHeaderSize - 17
+	webPushDefaultTTL     = 24 * time.Hour
+	webPushVAPIDLifetime  = 12 * time.Hour
+	webPushMaxConcurrency = 10
+)
+
+// errNoWebPushSubscription is returned for a device registered without a subscription;
+// retrying cannot fix it
+var errNoWebPushSubscription = apperrors.Permanent(errors.New("device has no web push subscription"))
+
+// WebPushSubscription is the browser PushSubscription a device registered with
+type WebPushSubscription struct {
+	Endpoint string
+	P256dh   string // base64url encoded client public key
+	Auth     string // base64url encoded authentication secret
+}
+
+// WebPushClient delivers notifications straight to browser push services
+// (RFC 8030) with aes128gcm payload encryption (RFC 8291) and VAPID (RFC 8292)
+type WebPushClient struct {
+	publicKey  string
+	privateKey *ecdsa.PrivateKey
+	subject    string
+	httpClient *http.Client
+}
+
+func NewWebPushClient(cfg *config.Config) (*WebPushClient, error) {
+	if cfg.VAPIDPublicKey == "" || cfg.VAPIDPrivateKey == "" {
+		return nil, fmt.Errorf("VAPID public and private keys are required")
+	}
+	if cfg.VAPIDSubject == "" {
+		return nil, fmt.Errorf("VAPID subject is required")
+	}
+
+	rawPrivate, err := decodeBase64URL(cfg.VAPIDPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode VAPID private key: %w", err)
+	}
+	privateKey, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), rawPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse VAPID private key: %w", err)
+	}
+
+	return &WebPushClient{
+		publicKey:  cfg.VAPIDPublicKey,
+		privateKey: privateKey,
+		subject:    cfg.VAPIDSubject,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type webPushPayload struct {
+	Title   string                 `json:"title,omitempty"`
+	Body    string                 `json:"body,omitempty"`
+	Image   string                 `json:"image,omitempty"`
+	URL     string                 `json:"url,omitempty"` // opened by the service worker on click
+	Tag     string                 `json:"tag,omitempty"`
+	Actions []webPushAction        `json:"actions,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// webPushAction mirrors a NotificationAction for the service worker's showNotification
+type webPushAction struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	Icon   string `json:"icon,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+// newWebPushPayload builds the JSON the service worker receives for a localized message
+func newWebPushPayload(msg *PushMessage) webPushPayload {
+	// Browsers require a push to show something; for a silent push the service worker decides what
+	if msg.Silent() {
+		return webPushPayload{Data: msg.Data}
+	}
+	payload := webPushPayload{
+		Title: msg.Title,
+		Body:  msg.Message,
+		Image: msg.ImageURL,
+		URL:   msg.URL,
+		Tag:   msg.Group,
+		Data:  msg.Data,
+	}
+	for _, button := range msg.Buttons {
+		payload.Actions = append(payload.Actions, webPushAction{Action: button.ID, Title: button.Text, Icon: button.Icon, URL: button.URL})
+	}
+	return payload
+}
+
+// Name returns the provider identifier
+func (c *WebPushClient) Name() string {
+	return ProviderWebPush
+}
+
+// Capabilities reports what Web Push supports
+func (c *WebPushClient) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{
+		Platforms:     []string{"web"},
+		Segments:      false,
+		DeviceListing: false,
+	}
+}
+
+// SendToDevices encrypts and posts the notification to each subscription endpoint
+func (c *WebPushClient) SendToDevices(devices []Device, msg *PushMessage) (*SendResult, error) {
+	// One payload per language the devices are in
+	plaintexts := make(map[string][]byte)
+	for _, device := range devices {
+		if _, ok := plaintexts[device.Locale]; ok {
+			continue
+		}
+		plaintext, err := json.Marshal(newWebPushPayload(msg.ForLocale(device.Locale)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal notification: %w", err)
+		}
+		plaintexts[device.Locale] = plaintext
+	}
+
+	results := make([]DeviceResult, len(devices))
+	var lastErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, webPushMaxConcurrency)
+
+	for i, device := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, device Device) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = DeviceResult{Token: device.Token}
+			if device.WebPush == nil {
+				results[i].Error = errNoWebPushSubscription.Error()
+				mu.Lock()
+				lastErr = errNoWebPushSubscription
+				mu.Unlock()
+				return
+			}
+
+			messageID, err := c.send(device.WebPush, plaintexts[device.Locale], msg)
+			if err != nil {
+				results[i].Error = err.Error()
+				results[i].Transient = IsTransientError(err)
+				var apiErr *APIError
+				if errors.As(err, &apiErr) {
+					results[i].ErrorCode = apiErr.Code
+					// The push service forgot the subscription, the browser unsubscribed
+					results[i].Unregistered = apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone
+				}
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+				return
+			}
+			results[i].MessageID = messageID
+		}(i, device)
+	}
+	wg.Wait()
+
+	res := &SendResult{Provider: ProviderWebPush, Results: results}
+	for _, r := range results {
+		if r.Error != "" {
+			res.Errors = append(res.Errors, fmt.Sprintf("%s: %s", r.Token, r.Error))
+			continue
+		}
+		res.Recipients++
+		if res.ID == "" {
+			res.ID = r.MessageID
+		}
+	}
+
+	if res.Recipients == 0 && lastErr != nil {
+		return res, fmt.Errorf("webpush: all %d sends failed: %w", len(devices), lastErr)
+	}
+	return res, nil
+}
+
+// SendToSegment is not supported by Web Push
+func (c *WebPushClient) SendToSegment(segment string, msg *PushMessage) (*SendResult, error) {
+	return nil, fmt.Errorf("webpush does not support segments")
+}
+
+// ListDevices is not supported by Web Push
+func (c *WebPushClient) ListDevices(limit, offset int) (*PlayersResponse, error) {
+	return nil, fmt.Errorf("webpush does not support device listing")
+}
+
+// send encrypts the payload for one subscription and delivers it to the push service
+func (c *WebPushClient) send(sub *WebPushSubscription, plaintext []byte, msg *PushMessage) (string, error) {
+	body, err := encryptWebPushPayload(plaintext, sub)
+	if err != nil {
+		return "", err
+	}
+
+	authorization, err := c.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	ttl := webPushDefaultTTL
+	if msg.TTL != nil {
+		ttl = *msg.TTL
+	}
+
+	req.Header.Add("Authorization", authorization)
+	req.Header.Add("Content-Encoding", "aes128gcm")
+	req.Header.Add("Content-Type", "application/octet-stream")
+	req.Header.Add("TTL", strconv.Itoa(int(ttl.Seconds())))
+	req.Header.Add("Urgency", webPushUrgency(msg.Priority))
+	if msg.CollapseID != "" {
+		req.Header.Add("Topic", msg.CollapseID)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", requestError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		resBody, _ := io.ReadAll(res.Body)
+		apiErr := newAPIError(ProviderWebPush, res, resBody)
+		apiErr.Code = http.StatusText(res.StatusCode)
+		return "", apiErr
+	}
+
+	return res.Header.Get("Location"), nil
+}
+
+// vapidAuthorization builds the VAPID Authorization header for the endpoint's origin
+func (c *WebPushClient) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid subscription endpoint: %w", err)
+	}
+
+	token, err := encodeJWT(
+		map[string]string{"typ": "JWT", "alg": "ES256"},
+		map[string]interface{}{
+			"aud": u.Scheme + "://" + u.Host,
+			"exp": time.Now().Add(webPushVAPIDLifetime).Unix(),
+			"sub": c.subject,
+		},
+		es256Signer(c.privateKey),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("vapid t=%s, k=%s", token, c.publicKey), nil
+}
+
+// encryptWebPushPayload encrypts plaintext into a single aes128gcm record as described in RFC 8291
+func encryptWebPushPayload(plaintext []byte, sub *WebPushSubscription) ([]byte, error) {
+	// Push services take 4096 bytes of body: the header, then one record holding the
+	// payload, the padding delimiter and the 16 byte GCM tag
+	if len(plaintext) > webPushMaxPayload {
+		return nil, apperrors.Permanent(fmt.Errorf("web push payload too large: %d bytes, at most %d", len(plaintext), webPushMaxPayload))
+	}
+
+	uaPublicBytes, err := decodeBase64URL(sub.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := decodeBase64URL(sub.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+
+	curve := ecdh.P256()
+	uaPublic, err := curve.NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+
+	// A fresh application server key pair per message
+	asPrivate, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+
+	keyInfo := "WebPush: info\x00" + string(uaPublicBytes) + string(asPublicBytes)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// 0x02 marks the last (and only) record
+	record := append(append([]byte{}, plaintext...), 0x02)
+	ciphertext := gcm.Seal(nil, nonce, record, nil)
+
+	// Header: salt (16) | record size (4) | key id length (1) | key id
+	header := make([]byte, 0, 21+len(asPublicBytes))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+
+	return append(header, ciphertext...), nil
+}
+
+// webPushUrgency maps our priority onto the RFC 8030 Urgency header
+func webPushUrgency(priority string) string {
+	if priority == "high" {
+		return "high"
+	}
+	return "normal"
+}
+
+// decodeBase64URL accepts base64url with or without padding, as browsers vary
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
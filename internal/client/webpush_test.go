@@ -0,0 +1,311 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/config"
+)
+
+// browserSubscription is the user agent side of a push subscription: it holds the
+// private key and auth secret needed to decrypt what the push service delivers
+type browserSubscription struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newBrowserSubscription(t *testing.T) *browserSubscription {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return &browserSubscription{key: key, auth: auth}
+}
+
+func (b *browserSubscription) subscription(endpoint string) *WebPushSubscription {
+	return &WebPushSubscription{
+		Endpoint: endpoint,
+		P256dh:   base64.RawURLEncoding.EncodeToString(b.key.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(b.auth),
+	}
+}
+
+// decrypt reverses RFC 8291 aes128gcm encryption the way a browser does
+func (b *browserSubscription) decrypt(t *testing.T, body []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("body of %d bytes is shorter than the aes128gcm header", len(body))
+	}
+	salt := body[:16]
+	recordSize := binary.BigEndian.Uint32(body[16:20])
+	keyIDLen := int(body[20])
+	asPublicBytes := body[21 : 21+keyIDLen]
+	ciphertext := body[21+keyIDLen:]
+	if recordSize != webPushRecordSize || uint32(len(ciphertext)) > recordSize {
+		t.Fatalf("record size %d with %d bytes of ciphertext", recordSize, len(ciphertext))
+	}
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatalf("key id is not a P-256 public key: %v", err)
+	}
+	ecdhSecret, err := b.key.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := "WebPush: info\x00" + string(b.key.PublicKey().Bytes()) + string(asPublicBytes)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, b.auth, keyInfo, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt record: %v", err)
+	}
+
+	// Padding is zeros after a 0x02 delimiter on the last record
+	record = bytes.TrimRight(record, "\x00")
+	if len(record) == 0 || record[len(record)-1] != 0x02 {
+		t.Fatal("record does not end with the last-record delimiter")
+	}
+	return record[:len(record)-1]
+}
+
+// fakePushService is a browser push service endpoint that records each push
+type fakePushService struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	status   int // response status, 201 when zero
+}
+
+func (f *fakePushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	w.Header().Set("Location", "https://push.example.com/messages/1")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func newTestWebPushClient(t *testing.T, httpClient *http.Client) *WebPushClient {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewWebPushClient(&config.Config{
+		VAPIDPublicKey:  base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		VAPIDPrivateKey: base64.RawURLEncoding.EncodeToString(key.Bytes()),
+		VAPIDSubject:    "mailto:ops@example.com",
+	})
+	if err != nil {
+		t.Fatalf("NewWebPushClient: %v", err)
+	}
+	if httpClient != nil {
+		c.httpClient = httpClient
+	}
+	return c
+}
+
+func TestWebPushDeviceWithoutSubscriptionFailsPermanently(t *testing.T) {
+	c := newTestWebPushClient(t, nil)
+
+	res, err := c.SendToDevices([]Device{{Token: "browser-1", Platform: "web"}}, &PushMessage{Title: "hi"})
+	if !errors.Is(err, apperrors.ErrProviderPermanent) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+	if res.Recipients != 0 || len(res.Results) != 1 || res.Results[0].Error == "" || res.Results[0].Transient {
+		t.Errorf("result = %+v, want one permanently failed device", res)
+	}
+}
+
+func TestWebPushPayloadRoundTrip(t *testing.T) {
+	browser := newBrowserSubscription(t)
+	plaintext := []byte(`{"title":"Hello","body":"World"}`)
+
+	body, err := encryptWebPushPayload(plaintext, browser.subscription("https://push.example.com/send/1"))
+	if err != nil {
+		t.Fatalf("encryptWebPushPayload: %v", err)
+	}
+	if got := browser.decrypt(t, body); !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypted %q, want %q", got, plaintext)
+	}
+
+	// A fresh key and salt per message
+	again, err := encryptWebPushPayload(plaintext, browser.subscription("https://push.example.com/send/1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(body[:16], again[:16]) || bytes.Equal(body[21:86], again[21:86]) {
+		t.Error("salt or ephemeral key reused between messages")
+	}
+}
+
+func TestWebPushPayloadTooLarge(t *testing.T) {
+	browser := newBrowserSubscription(t)
+	sub := browser.subscription("https://push.example.com/send/1")
+
+	// The largest payload fills the 4096 byte body push services accept
+	body, err := encryptWebPushPayload(make([]byte, webPushMaxPayload), sub)
+	if err != nil {
+		t.Fatalf("encryptWebPushPayload at the limit: %v", err)
+	}
+	if len(body) != 4096 {
+		t.Errorf("body is %d bytes, want 4096", len(body))
+	}
+
+	_, err = encryptWebPushPayload(make([]byte, webPushMaxPayload+1), sub)
+	if !errors.Is(err, apperrors.ErrProviderPermanent) {
+		t.Fatalf("err = %v, want a permanent error for a payload over the limit", err)
+	}
+}
+
+func TestWebPushSendToDevices(t *testing.T) {
+	fake := &fakePushService{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := newTestWebPushClient(t, server.Client())
+	browser := newBrowserSubscription(t)
+
+	ttl := 90 * time.Second
+	msg := &PushMessage{Title: "Sale", Message: "50% off", URL: "https://shop.example.com", Priority: "high", TTL: &ttl, CollapseID: "sale"}
+	res, err := c.SendToDevices([]Device{{Token: "browser-1", Platform: "web", WebPush: browser.subscription(server.URL + "/send/1")}}, msg)
+	if err != nil {
+		t.Fatalf("SendToDevices: %v", err)
+	}
+	if res.Recipients != 1 || res.ID != "https://push.example.com/messages/1" {
+		t.Errorf("result = %+v, want one recipient with the message location", res)
+	}
+
+	req := fake.requests[0]
+	want := map[string]string{"Content-Encoding": "aes128gcm", "TTL": "90", "Urgency": "high", "Topic": "sale"}
+	for header, value := range want {
+		if got := req.Header.Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+	verifyVAPID(t, req.Header.Get("Authorization"), server.URL)
+
+	var payload webPushPayload
+	if err := json.Unmarshal(browser.decrypt(t, fake.bodies[0]), &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	if payload.Title != "Sale" || payload.Body != "50% off" || payload.URL != "https://shop.example.com" {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestWebPushGoneSubscriptionIsUnregistered(t *testing.T) {
+	fake := &fakePushService{status: http.StatusGone}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := newTestWebPushClient(t, server.Client())
+	browser := newBrowserSubscription(t)
+
+	res, err := c.SendToDevices([]Device{{Token: "browser-1", WebPush: browser.subscription(server.URL + "/send/1")}}, &PushMessage{Title: "hi"})
+	if !errors.Is(err, apperrors.ErrProviderPermanent) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+	if !res.Results[0].Unregistered || res.Results[0].Transient {
+		t.Errorf("result = %+v, want the subscription unregistered", res.Results[0])
+	}
+}
+
+// verifyVAPID checks a "vapid t=<jwt>, k=<key>" header is signed by k for the endpoint's origin
+func verifyVAPID(t *testing.T, authorization, origin string) {
+	t.Helper()
+	var token, key string
+	for _, part := range strings.Split(strings.TrimPrefix(authorization, "vapid "), ", ") {
+		switch {
+		case strings.HasPrefix(part, "t="):
+			token = strings.TrimPrefix(part, "t=")
+		case strings.HasPrefix(part, "k="):
+			key = strings.TrimPrefix(part, "k=")
+		}
+	}
+	rawKey, err := decodeBase64URL(key)
+	if err != nil {
+		t.Fatalf("invalid VAPID key %q: %v", key, err)
+	}
+	publicKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), rawKey)
+	if err != nil {
+		t.Fatalf("invalid VAPID key: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("VAPID token %q is not a JWT", token)
+	}
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("invalid ES256 signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("VAPID token is not signed by the advertised key")
+	}
+
+	rawClaims, err := decodeBase64URL(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != origin || claims.Sub == "" || time.Unix(claims.Exp, 0).Before(time.Now()) {
+		t.Errorf("claims = %+v, want aud %s, a subject and a future expiry", claims, origin)
+	}
+}
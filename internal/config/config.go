@@ -1,15 +1,77 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 type Config struct {
 	RabbitMQURL    string `mapstructure:"RABBITMQ_URL"`
 	OneSignalKey   string `mapstructure:"ONESIGNAL_KEY"`
 	OneSignalAppID string `mapstructure:"ONESIGNAL_APP_ID"`
-	PostgresUrl    string `mapstructure:"POSTGRES_URL"`
-	RedisURL       string `mapstructure:"REDIS_URL"`
-	Port           string `mapstructure:"PORT"`
-	ServiceName    string `mapstructure:"SERVICE_NAME"`
+	// Shared secret OneSignal webhooks are verified with, webhooks are refused while unset
+	OneSignalWebhookSecret string `mapstructure:"ONESIGNAL_WEBHOOK_SECRET"`
+	// Also accept the secret as ?secret= for senders that cannot sign. Off by default:
+	// the secret then ends up in access logs and proxies.
+	OneSignalSecretInQuery bool   `mapstructure:"ONESIGNAL_WEBHOOK_QUERY_SECRET"`
+	PostgresUrl            string `mapstructure:"POSTGRES_URL"`
+	RedisURL               string `mapstructure:"REDIS_URL"`
+	Port                   string `mapstructure:"PORT"`
+	ServiceName            string `mapstructure:"SERVICE_NAME"`
+	PushProvider           string `mapstructure:"PUSH_PROVIDER"` // onesignal, fcm, apns, webpush
+	PushRoutes             string `mapstructure:"PUSH_ROUTES"`   // e.g. ios=apns,onesignal;android=fcm,onesignal
+
+	// Delayed retries for transient queue failures
+	RetryMaxAttempts int           `mapstructure:"RETRY_MAX_ATTEMPTS"`
+	RetryBaseDelay   time.Duration `mapstructure:"RETRY_BASE_DELAY"`
+	RetryMaxDelay    time.Duration `mapstructure:"RETRY_MAX_DELAY"`
+
+	// Outbound publishing
+	PublishExchange       string        `mapstructure:"PUBLISH_EXCHANGE"` // topic exchange for messages to other services
+	PublishRoutes         string        `mapstructure:"PUBLISH_ROUTES"`   // e.g. user=user.send;email=email.send
+	StatusExchange        string        `mapstructure:"STATUS_EXCHANGE"`  // topic exchange for delivery status events
+	PublishPoolSize       int           `mapstructure:"PUBLISH_POOL_SIZE"`
+	PublishConfirmTimeout time.Duration `mapstructure:"PUBLISH_CONFIRM_TIMEOUT"`
+
+	// Transactional outbox relay
+	OutboxPollInterval time.Duration `mapstructure:"OUTBOX_POLL_INTERVAL"`
+	OutboxBatchSize    int           `mapstructure:"OUTBOX_BATCH_SIZE"`
+
+	// Delivery outcome reconciliation
+	ReconcileInterval       time.Duration `mapstructure:"RECONCILE_INTERVAL"`
+	ReconcileBatchSize      int           `mapstructure:"RECONCILE_BATCH_SIZE"`
+	NotificationExpireAfter time.Duration `mapstructure:"NOTIFICATION_EXPIRE_AFTER"` // unfinished notifications expire after this
+
+	// Template service used for sends that carry a template_id
+	TemplateServiceURL      string        `mapstructure:"TEMPLATE_SERVICE_URL"`
+	TemplateVersionCacheTTL time.Duration `mapstructure:"TEMPLATE_VERSION_CACHE_TTL"` // how long a template's version is trusted before re-checking
+
+	// Localized content: the locale used when a device's own locale has no content
+	DefaultLocale   string `mapstructure:"DEFAULT_LOCALE"`
+	LocaleFallbacks string `mapstructure:"LOCALE_FALLBACKS"` // e.g. pt-BR=pt-PT;es-MX=es-ES
+
+	// How long a claimed notification_id is held before another attempt may take it over
+	IdempotencyLease time.Duration `mapstructure:"IDEMPOTENCY_LEASE"`
+
+	// Firebase Cloud Messaging (HTTP v1)
+	FCMCredentialsFile string `mapstructure:"FCM_CREDENTIALS_FILE"` // service account key JSON
+	FCMProjectID       string `mapstructure:"FCM_PROJECT_ID"`       // defaults to the service account project
+	FCMEndpoint        string `mapstructure:"FCM_ENDPOINT"`         // override for a local fake server
+	FCMTokenURL        string `mapstructure:"FCM_TOKEN_URL"`        // override for a local fake server
+
+	// Apple Push Notification service (token-based auth)
+	APNsKeyFile  string `mapstructure:"APNS_KEY_FILE"` // .p8 signing key
+	APNsKeyID    string `mapstructure:"APNS_KEY_ID"`
+	APNsTeamID   string `mapstructure:"APNS_TEAM_ID"`
+	APNsTopic    string `mapstructure:"APNS_TOPIC"` // app bundle ID
+	APNsSandbox  bool   `mapstructure:"APNS_SANDBOX"`
+	APNsEndpoint string `mapstructure:"APNS_ENDPOINT"` // override for a local fake server
+
+	// Standards-based Web Push (VAPID keys are base64url encoded)
+	VAPIDPublicKey  string `mapstructure:"VAPID_PUBLIC_KEY"`
+	VAPIDPrivateKey string `mapstructure:"VAPID_PRIVATE_KEY"`
+	VAPIDSubject    string `mapstructure:"VAPID_SUBJECT"` // mailto: or https: contact
 }
 
 func LoadConfig() (*Config, error) {
@@ -18,6 +80,25 @@ func LoadConfig() (*Config, error) {
 	viper.SetConfigName(".env")
 	viper.SetConfigType("env")
 	viper.AutomaticEnv()
+	viper.SetDefault("PUSH_PROVIDER", "onesignal")
+	viper.SetDefault("RETRY_MAX_ATTEMPTS", 5)
+	viper.SetDefault("RETRY_BASE_DELAY", "2s")
+	viper.SetDefault("RETRY_MAX_DELAY", "5m")
+	viper.SetDefault("PUBLISH_EXCHANGE", "notifications.direct")
+	viper.SetDefault("PUBLISH_ROUTES", "user=user.send;email=email.send;template=template.send")
+	viper.SetDefault("STATUS_EXCHANGE", "notification.status")
+	viper.SetDefault("PUBLISH_POOL_SIZE", 4)
+	viper.SetDefault("PUBLISH_CONFIRM_TIMEOUT", "5s")
+	viper.SetDefault("OUTBOX_POLL_INTERVAL", "1s")
+	viper.SetDefault("OUTBOX_BATCH_SIZE", 100)
+	viper.SetDefault("IDEMPOTENCY_LEASE", "5m")
+	viper.SetDefault("RECONCILE_INTERVAL", "1m")
+	viper.SetDefault("TEMPLATE_SERVICE_URL", "http://localhost:8004/api")
+	viper.SetDefault("TEMPLATE_VERSION_CACHE_TTL", "1m")
+	viper.SetDefault("DEFAULT_LOCALE", "en")
+	viper.SetDefault("RECONCILE_BATCH_SIZE", 100)
+	viper.SetDefault("NOTIFICATION_EXPIRE_AFTER", "72h")
+	viper.SetDefault("ONESIGNAL_WEBHOOK_QUERY_SECRET", false)
 	var err error
 	if err = viper.ReadInConfig(); err != nil {
 		return nil, err
@@ -10,8 +10,17 @@ type GetHealthResponse struct {
 }
 
 type DependenciesStatus struct {
-	RabbitMQ   string `json:"rabbitmq"`
-	PostgreSQL string `json:"postgresql"`
+	RabbitMQ        string        `json:"rabbitmq"`
+	RabbitMQDetails *BrokerStatus `json:"rabbitmq_details,omitempty"`
+	PostgreSQL      string        `json:"postgresql"`
+}
+
+// BrokerStatus describes the RabbitMQ connection and its reconnect history
+type BrokerStatus struct {
+	State      string    `json:"state"` // connected | reconnecting | closed
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+	Since      time.Time `json:"since"`
 }
 
 type PushRequest struct {
@@ -19,37 +28,131 @@ type PushRequest struct {
 	UserID         string                 `json:"user_id"`
 	Title          string                 `json:"title,omitempty"`
 	Message        string                 `json:"message,omitempty"`
+	Titles         map[string]string      `json:"titles,omitempty"`   // language tag -> title, e.g. {"pt-BR": "..."}
+	Messages       map[string]string      `json:"messages,omitempty"` // language tag -> body
 	TemplateID     string                 `json:"template_id,omitempty"`
 	TemplateVars   map[string]string      `json:"template_variables,omitempty"`
 	Data           map[string]interface{} `json:"data,omitempty"`
-	Priority       string                 `json:"priority,omitempty"` // "high" | "normal"
+	Priority       string                 `json:"priority,omitempty"`    // "high" | "normal"
+	TTL            *int                   `json:"ttl,omitempty"`         // seconds the provider keeps trying, 0 means now or never
+	CollapseID     string                 `json:"collapse_id,omitempty"` // a newer push with the same ID replaces an undelivered one
+	Silent         bool                   `json:"silent,omitempty"`      // data-only background push, nothing is shown
 	CorrelationID  string                 `json:"correlation_id"`
+
+	// Rich content, honoured by providers that support it
+	ImageURL         string       `json:"image_url,omitempty"`          // big picture / iOS attachment, http(s)
+	URL              string       `json:"url,omitempty"`                // web page opened on click, http(s)
+	DeepLink         string       `json:"deep_link,omitempty"`          // app URL opened on click, e.g. myapp://orders/234
+	Buttons          []PushButton `json:"buttons,omitempty"`            // up to 3 action buttons
+	Sound            string       `json:"sound,omitempty"`              // sound file bundled with the app
+	BadgeIncrement   int          `json:"badge_increment,omitempty"`    // iOS badge change, negative to decrease
+	AndroidChannelID string       `json:"android_channel_id,omitempty"` // Android notification channel
+	Group            string       `json:"group,omitempty"`              // iOS thread ID / Android group key
+}
+
+// PushButton is an action button shown with a notification
+type PushButton struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	Icon string `json:"icon,omitempty"`
+	URL  string `json:"url,omitempty"` // web buttons only
 }
 
 type TokenUpdate struct {
-	UserID            string `json:"user_id"`
-	DeviceToken       string `json:"device_token"`
-	Platform          string `json:"platform"` // "ios", "android", "web"
-	OneSignalPlayerID string `json:"onesignal_player_id,omitempty"`
+	UserID            string               `json:"user_id"`
+	DeviceToken       string               `json:"device_token"`
+	Platform          string               `json:"platform"`           // "ios", "android", "web"
+	Provider          string               `json:"provider,omitempty"` // "fcm", "apns"; inferred from platform when empty
+	OneSignalPlayerID string               `json:"onesignal_player_id,omitempty"`
+	Subscription      *WebPushSubscription `json:"subscription,omitempty"` // browser PushSubscription.toJSON()
+	AppVersion        string               `json:"app_version,omitempty"`
+	Locale            string               `json:"locale,omitempty"`   // e.g. "pt-BR"
+	Timezone          string               `json:"timezone,omitempty"` // e.g. "Africa/Lagos"
+}
+
+// WebPushSubscription mirrors the JSON form of a browser PushSubscription
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type VAPIDPublicKeyResponse struct {
+	PublicKey string `json:"public_key"`
 }
 
 type PushResponse struct {
-	Success        bool     `json:"success"`
-	NotificationID string   `json:"notification_id,omitempty"`
-	Recipients     int      `json:"recipients"`
-	Errors         []string `json:"errors,omitempty"`
-	Message        string   `json:"message,omitempty"`
+	Success           bool     `json:"success"`
+	NotificationID    string   `json:"notification_id,omitempty"`
+	ProviderMessageID string   `json:"provider_message_id,omitempty"`
+	Provider          string   `json:"provider,omitempty"` // provider(s) that delivered
+	Recipients        int      `json:"recipients"`
+	Errors            []string `json:"errors,omitempty"`
+	Message           string   `json:"message,omitempty"`
+}
+
+// Notification kinds, recorded so silent pushes can be told apart from ones the user sees
+const (
+	NotificationKindAlert  = "alert"
+	NotificationKindSilent = "silent" // data only, never displayed, so never delivered or clicked
+)
+
+// Kind returns the notification kind of the request
+func (r *PushRequest) Kind() string {
+	if r.Silent {
+		return NotificationKindSilent
+	}
+	return NotificationKindAlert
 }
 
-// NotificationStatus represents the status of a notification
+// NotificationStatus represents the status of a notification. A notification moves
+// queued -> sending -> sent and ends as delivered, failed, expired or cancelled.
 type NotificationStatus string
 
 const (
+	NotificationStatusQueued    NotificationStatus = "queued"
+	NotificationStatusSending   NotificationStatus = "sending"
+	NotificationStatusSent      NotificationStatus = "sent" // accepted by the provider
 	NotificationStatusDelivered NotificationStatus = "delivered"
-	NotificationStatusPending   NotificationStatus = "pending"
 	NotificationStatusFailed    NotificationStatus = "failed"
+	NotificationStatusExpired   NotificationStatus = "expired"
+	NotificationStatusCancelled NotificationStatus = "cancelled"
 )
 
+// statusTransitions lists the statuses each status may move to. Terminal statuses have none.
+var statusTransitions = map[NotificationStatus][]NotificationStatus{
+	NotificationStatusQueued:    {NotificationStatusSending, NotificationStatusSent, NotificationStatusFailed, NotificationStatusExpired, NotificationStatusCancelled},
+	NotificationStatusSending:   {NotificationStatusQueued, NotificationStatusSent, NotificationStatusFailed, NotificationStatusExpired},
+	NotificationStatusSent:      {NotificationStatusDelivered, NotificationStatusFailed, NotificationStatusExpired},
+	NotificationStatusDelivered: nil,
+	NotificationStatusFailed:    nil,
+	NotificationStatusExpired:   nil,
+	NotificationStatusCancelled: nil,
+}
+
+// Valid reports whether s is a known status
+func (s NotificationStatus) Valid() bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// Terminal reports whether no further transition is allowed from s
+func (s NotificationStatus) Terminal() bool {
+	return s.Valid() && len(statusTransitions[s]) == 0
+}
+
+// CanTransitionTo reports whether a notification in status s may move to next
+func (s NotificationStatus) CanTransitionTo(next NotificationStatus) bool {
+	for _, allowed := range statusTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
 // NotificationStatusUpdate represents a status update for a notification
 type NotificationStatusUpdate struct {
 	NotificationID string             `json:"notification_id" validate:"required"`
@@ -58,12 +161,92 @@ type NotificationStatusUpdate struct {
 	Error          *string            `json:"error,omitempty"`
 }
 
-// NotificationStatusResponse represents the response for status queries
-type NotificationStatusResponse struct {
+// NotificationStatusEvent is published to the status exchange whenever a
+// notification log is created or its status changes
+type NotificationStatusEvent struct {
 	NotificationID string             `json:"notification_id"`
+	UserID         string             `json:"user_id"`
+	Kind           string             `json:"kind,omitempty"` // alert | silent
 	Status         NotificationStatus `json:"status"`
-	Timestamp      time.Time          `json:"timestamp"`
+	Provider       string             `json:"provider,omitempty"`
+	Recipients     int                `json:"recipients"`
 	Error          *string            `json:"error,omitempty"`
-	UserID         string             `json:"user_id,omitempty"`
-	Recipients     int                `json:"recipients,omitempty"`
+	CorrelationID  string             `json:"correlation_id,omitempty"`
+	Timestamp      time.Time          `json:"timestamp"`
+}
+
+// NotificationStatusResponse represents the response for status queries
+type NotificationStatusResponse struct {
+	NotificationID    string             `json:"notification_id"`
+	ProviderMessageID string             `json:"provider_message_id,omitempty"`
+	Kind              string             `json:"kind,omitempty"` // alert | silent
+	Status            NotificationStatus `json:"status"`
+	Timestamp         time.Time          `json:"timestamp"`
+	Error             *string            `json:"error,omitempty"`
+	UserID            string             `json:"user_id,omitempty"`
+	Recipients        int                `json:"recipients,omitempty"`
+	Provider          string             `json:"provider,omitempty"` // provider(s) that actually delivered
+	Attempts          []ProviderAttempt  `json:"attempts,omitempty"`
+	Deliveries        []DeviceDelivery   `json:"deliveries,omitempty"`
+	History           []StatusChange     `json:"history,omitempty"`
+}
+
+// StatusChange is one entry in a notification's status history
+type StatusChange struct {
+	From      NotificationStatus `json:"from,omitempty"`
+	To        NotificationStatus `json:"to"`
+	Source    string             `json:"source"`
+	Error     *string            `json:"error,omitempty"`
+	Timestamp time.Time          `json:"timestamp"`
+}
+
+// DeviceDelivery is the outcome of a notification for a single device
+type DeviceDelivery struct {
+	DeviceID          uint               `json:"device_id"`
+	Platform          string             `json:"platform"`
+	Provider          string             `json:"provider,omitempty"`
+	ProviderMessageID string             `json:"provider_message_id,omitempty"`
+	Status            NotificationStatus `json:"status"`
+	ErrorCode         string             `json:"error_code,omitempty"`
+	Error             *string            `json:"error,omitempty"`
+	Attempts          int                `json:"attempts"`
+	SentAt            *time.Time         `json:"sent_at,omitempty"`
+	DeliveredAt       *time.Time         `json:"delivered_at,omitempty"`
+	ClickedAt         *time.Time         `json:"clicked_at,omitempty"`
+	DismissedAt       *time.Time         `json:"dismissed_at,omitempty"`
+	Timestamp         time.Time          `json:"timestamp"`
+}
+
+// OneSignalSignatureHeader carries the hex HMAC-SHA256 of a webhook body
+const OneSignalSignatureHeader = "X-OneSignal-Signature"
+
+// OneSignal webhook events
+const (
+	OneSignalEventDisplayed = "notification.displayed"
+	OneSignalEventClicked   = "notification.clicked"
+	OneSignalEventDismissed = "notification.dismissed"
+)
+
+// OneSignalWebhookEvent is the body OneSignal posts for display, click and dismiss events
+type OneSignalWebhookEvent struct {
+	Event          string                 `json:"event"`
+	ID             string                 `json:"id"`             // OneSignal notification ID
+	NotificationID string                 `json:"notificationId"` // sent instead of id by some SDKs
+	UserID         string                 `json:"userId"`         // player (subscription) ID of the device
+	Heading        string                 `json:"heading,omitempty"`
+	Content        string                 `json:"content,omitempty"`
+	URL            string                 `json:"url,omitempty"`
+	Data           map[string]interface{} `json:"data,omitempty"`
+	Timestamp      int64                  `json:"timestamp,omitempty"` // unix seconds
+}
+
+// ProviderAttempt is one provider call made while delivering a notification
+type ProviderAttempt struct {
+	Provider   string    `json:"provider"`
+	Devices    int       `json:"devices"`
+	Recipients int       `json:"recipients"`
+	Fallback   bool      `json:"fallback"`
+	Error      *string   `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	Timestamp  time.Time `json:"timestamp"`
 }
@@ -0,0 +1,52 @@
+package dto
+
+import "testing"
+
+func TestNotificationStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from, to NotificationStatus
+		want     bool
+	}{
+		{NotificationStatusQueued, NotificationStatusSending, true},
+		{NotificationStatusQueued, NotificationStatusSent, true},
+		{NotificationStatusQueued, NotificationStatusCancelled, true},
+		{NotificationStatusQueued, NotificationStatusExpired, true},
+		{NotificationStatusQueued, NotificationStatusDelivered, false},
+		{NotificationStatusSending, NotificationStatusQueued, true}, // a transient failure is retried
+		{NotificationStatusSending, NotificationStatusSent, true},
+		{NotificationStatusSending, NotificationStatusFailed, true},
+		{NotificationStatusSending, NotificationStatusExpired, true}, // stuck past its ttl or the expiry cutoff
+		{NotificationStatusSending, NotificationStatusCancelled, false},
+		{NotificationStatusSent, NotificationStatusDelivered, true},
+		{NotificationStatusSent, NotificationStatusExpired, true},
+		{NotificationStatusSent, NotificationStatusQueued, false},
+		{NotificationStatusSent, NotificationStatusSent, false},
+		{NotificationStatusDelivered, NotificationStatusFailed, false},
+		{NotificationStatusFailed, NotificationStatusQueued, false},
+		{NotificationStatusCancelled, NotificationStatusSending, false},
+		{NotificationStatus("bogus"), NotificationStatusSent, false},
+		{NotificationStatusQueued, NotificationStatus("bogus"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%s -> %s allowed = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestNotificationStatusTerminal(t *testing.T) {
+	for status, want := range map[NotificationStatus]bool{
+		NotificationStatusQueued:    false,
+		NotificationStatusSending:   false,
+		NotificationStatusSent:      false,
+		NotificationStatusDelivered: true,
+		NotificationStatusFailed:    true,
+		NotificationStatusExpired:   true,
+		NotificationStatusCancelled: true,
+		NotificationStatus("bogus"): false,
+	} {
+		if got := status.Terminal(); got != want {
+			t.Errorf("%s.Terminal() = %v, want %v", status, got, want)
+		}
+	}
+}
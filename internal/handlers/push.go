@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/whotterre/push_microservice/internal/apperrors"
 	"github.com/whotterre/push_microservice/internal/dto"
 	"github.com/whotterre/push_microservice/internal/services"
 )
@@ -37,15 +39,19 @@ func (h *PushHandler) SendPush(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	if req.CorrelationID == "" {
+		req.CorrelationID = c.Get("X-Correlation-ID")
+	}
 
 	response, err := h.pushService.SendPushNotification(&req)
 	if err != nil {
 		log.Printf("Failed to send push notification: %v", err)
 		if response != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(response)
+			return c.Status(errorStatus(err)).JSON(response)
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to send notification",
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error":   "Failed to send notification",
+			"details": err.Error(),
 		})
 	}
 
@@ -75,7 +81,7 @@ func (h *PushHandler) RegisterDevice(c *fiber.Ctx) error {
 
 	if err := h.pushService.ProcessTokenMessage(reqBytes); err != nil {
 		log.Printf("Failed to register device: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
 			"error":   "Failed to register device",
 			"details": err.Error(),
 		})
@@ -104,7 +110,7 @@ func (h *PushHandler) UpdateNotificationStatus(c *fiber.Ctx) error {
 
 	if err := h.pushService.UpdateNotificationStatus(&req); err != nil {
 		log.Printf("Failed to update notification status: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
 			"error":   "Failed to update notification status",
 			"details": err.Error(),
 		})
@@ -128,11 +134,61 @@ func (h *PushHandler) GetNotificationStatus(c *fiber.Ctx) error {
 	status, err := h.pushService.GetNotificationStatus(notificationID)
 	if err != nil {
 		log.Printf("Failed to get notification status: %v", err)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error":   "Notification not found",
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error":   "Failed to get notification status",
 			"details": err.Error(),
 		})
 	}
 
 	return c.Status(fiber.StatusOK).JSON(status)
 }
+
+// OneSignalWebhook ingests OneSignal display, click and dismiss events
+func (h *PushHandler) OneSignalWebhook(c *fiber.Ctx) error {
+	err := h.pushService.HandleOneSignalWebhook(c.Body(), c.Get(dto.OneSignalSignatureHeader), c.Query("secret"))
+	if err != nil {
+		log.Printf("Failed to handle OneSignal webhook: %v", err)
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error":   "Failed to handle webhook",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+	})
+}
+
+// GetVAPIDPublicKey returns the VAPID public key the frontend subscribes with
+func (h *PushHandler) GetVAPIDPublicKey(c *fiber.Ctx) error {
+	key, err := h.pushService.GetVAPIDPublicKey()
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error":   "VAPID public key not available",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(key)
+}
+
+// errorStatus maps a service error onto the HTTP status the caller should see
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, apperrors.ErrValidation):
+		return fiber.StatusBadRequest
+	case errors.Is(err, apperrors.ErrUnauthorized):
+		return fiber.StatusUnauthorized
+	case errors.Is(err, apperrors.ErrNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, apperrors.ErrConflict), errors.Is(err, apperrors.ErrInProgress):
+		return fiber.StatusConflict
+	case errors.Is(err, apperrors.ErrRateLimited):
+		return fiber.StatusTooManyRequests
+	case errors.Is(err, apperrors.ErrProviderTransient):
+		return fiber.StatusServiceUnavailable
+	case errors.Is(err, apperrors.ErrProviderPermanent):
+		return fiber.StatusBadGateway
+	}
+	return fiber.StatusInternalServerError
+}
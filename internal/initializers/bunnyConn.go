@@ -3,17 +3,17 @@ package initializers
 import (
 	"log"
 
-	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/whotterre/push_microservice/internal/queue"
 )
 
-
-func ConnectToRabbitMQ(connString string) (*amqp091.Connection, error){
-	var conn *amqp091.Connection
-	var err error
-	conn, err = amqp091.Dial(connString)
-	if err == nil {
-		return conn, nil
+// ConnectToRabbitMQ dials the broker and returns a manager that transparently
+// reconnects whenever the connection drops
+func ConnectToRabbitMQ(connString string) (*queue.ConnectionManager, error) {
+	conn := queue.NewConnectionManager(connString)
+	if err := conn.Connect(); err != nil {
+		log.Printf("Failed to connect to RabbitMQ: %v", err)
+		return nil, err
 	}
 	log.Println("Established connection to RabbitMQ")
-	return conn, err
-}
\ No newline at end of file
+	return conn, nil
+}
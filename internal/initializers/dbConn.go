@@ -19,10 +19,54 @@ func ConnectToDB(connString string) (*gorm.DB, error) {
 }
 
 func PerformMigrations(db *gorm.DB) error {
-	err := db.AutoMigrate(&models.UserDevice{}, &models.NotificationLog{})
+	err := db.AutoMigrate(&models.UserDevice{}, &models.NotificationLog{}, &models.NotificationAttempt{}, &models.NotificationDelivery{}, &models.NotificationStatusChange{}, &models.OutboxMessage{}, &models.IdempotencyKey{})
 	if err != nil {
 		log.Printf("Failed to perform migrations because: %s", err.Error())
 	}
+	if err := backfillDeviceTokens(db); err != nil {
+		log.Printf("Failed to backfill device tokens because: %s", err.Error())
+	}
+	if err := backfillNotificationStatuses(db); err != nil {
+		log.Printf("Failed to backfill notification statuses because: %s", err.Error())
+	}
 	log.Println("Successfully performed migrations")
 	return nil
 }
+
+// backfillDeviceTokens upgrades rows written before devices carried their own
+// provider token. Those rows were keyed by player_id alone, which held either a
+// OneSignal player ID or a Web Push endpoint. Every statement is idempotent.
+func backfillDeviceTokens(db *gorm.DB) error {
+	statements := []string{
+		// player_id is optional now that devices can be addressed by native token
+		`ALTER TABLE user_devices ALTER COLUMN player_id DROP NOT NULL`,
+		// Web Push rows used the endpoint as their player_id
+		`UPDATE user_devices SET provider = 'webpush', token = web_push_endpoint, player_id = NULL
+			WHERE (provider IS NULL OR provider = '') AND web_push_endpoint <> '' AND player_id = web_push_endpoint`,
+		// Everything else registered through OneSignal
+		`UPDATE user_devices SET provider = 'onesignal', token = player_id
+			WHERE (provider IS NULL OR provider = '') AND player_id IS NOT NULL`,
+		`UPDATE user_devices SET last_seen_at = updated_at WHERE last_seen_at IS NULL`,
+	}
+	for _, stmt := range statements {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillNotificationStatuses renames the pending status, which meant accepted by
+// the provider, to sent. Every statement is idempotent.
+func backfillNotificationStatuses(db *gorm.DB) error {
+	statements := []string{
+		`UPDATE notification_logs SET status = 'sent' WHERE status = 'pending'`,
+		`UPDATE notification_deliveries SET status = 'sent' WHERE status = 'pending'`,
+	}
+	for _, stmt := range statements {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
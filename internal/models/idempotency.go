@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// Idempotency key states
+const (
+	IdempotencyProcessing = "processing"
+	IdempotencyCompleted  = "completed"
+)
+
+// IdempotencyKey is claimed before a notification is sent, keyed by the caller's
+// notification_id, so a redelivered message or a retried request returns the
+// original result instead of sending the push again
+type IdempotencyKey struct {
+	Key         string     `gorm:"primaryKey;type:varchar(255)" json:"key"`
+	Status      string     `gorm:"type:varchar(20);not null" json:"status"` // processing, completed
+	Response    *string    `gorm:"type:text" json:"response,omitempty"`     // JSON result of the original send
+	ClaimedAt   time.Time  `gorm:"not null" json:"claimed_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// OutboxMessage is a message waiting to be published to RabbitMQ. It is written in
+// the same transaction as the change it announces and relayed afterwards, so the
+// database and the events other services see never diverge.
+type OutboxMessage struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	MessageID     string     `gorm:"uniqueIndex;not null" json:"message_id"` // AMQP message ID, stable across redeliveries
+	Exchange      string     `gorm:"type:varchar(255);not null" json:"exchange"`
+	RoutingKey    string     `gorm:"type:varchar(255);not null" json:"routing_key"`
+	CorrelationID string     `json:"correlation_id,omitempty"`
+	Payload       string     `gorm:"type:text;not null" json:"payload"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	LastError     *string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DispatchedAt  *time.Time `gorm:"index" json:"dispatched_at,omitempty"` // nil until the broker confirmed the publish
+}
@@ -4,25 +4,96 @@ import (
 	"time"
 )
 
-// UserDevice represents a user's subscribed device for push notifications
+// UserDevice represents a user's subscribed device for push notifications.
+// A device may be reachable through OneSignal (PlayerID), through its native
+// provider token (Provider + Token), or both.
 type UserDevice struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
 	UserID    string    `gorm:"index;not null" json:"user_id"`
-	PlayerID  string    `gorm:"uniqueIndex;not null" json:"player_id"`
+	PlayerID  *string   `gorm:"uniqueIndex" json:"player_id,omitempty"`
 	Platform  string    `gorm:"type:varchar(50)" json:"platform"` // web, ios, android
 	IsActive  bool      `gorm:"default:true" json:"is_active"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// Raw provider token: FCM registration token, APNs device token or Web Push endpoint
+	Provider string `gorm:"type:varchar(50);uniqueIndex:idx_user_devices_provider_token" json:"provider"` // onesignal, fcm, apns, webpush
+	Token    string `gorm:"type:text;uniqueIndex:idx_user_devices_provider_token" json:"-"`
+
+	// Browser PushSubscription for standards-based Web Push
+	WebPushEndpoint string `gorm:"type:text" json:"web_push_endpoint,omitempty"`
+	WebPushP256dh   string `gorm:"type:varchar(255)" json:"-"`
+	WebPushAuth     string `gorm:"type:varchar(255)" json:"-"`
+
+	AppVersion string     `gorm:"type:varchar(50)" json:"app_version,omitempty"`
+	Locale     string     `gorm:"type:varchar(35)" json:"locale,omitempty"`   // BCP 47, e.g. pt-BR
+	Timezone   string     `gorm:"type:varchar(64)" json:"timezone,omitempty"` // IANA, e.g. Africa/Lagos
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 
 // NotificationLog stores the status of sent notifications
 type NotificationLog struct {
+	ID                uint      `gorm:"primarykey" json:"id"`
+	NotificationID    string    `gorm:"uniqueIndex;not null" json:"notification_id"` // ours: the caller's notification_id or one we generated
+	ProviderMessageID string    `gorm:"index" json:"provider_message_id,omitempty"`  // the provider's ID for the send, e.g. the OneSignal notification ID
+	UserID            string    `gorm:"index;not null" json:"user_id"`
+	CorrelationID     string    `gorm:"index" json:"correlation_id,omitempty"`                     // from the originating request, echoed on status events
+	Kind              string    `gorm:"type:varchar(20);not null;default:alert;index" json:"kind"` // alert | silent, see dto.NotificationKind*
+	Status            string    `gorm:"not null" json:"status"`                                    // see dto.NotificationStatus
+	Recipients        int       `json:"recipients"`
+	Provider          string    `gorm:"type:varchar(100)" json:"provider,omitempty"` // provider(s) that delivered
+	Error             *string   `json:"error,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+
+	// Outcome counts reported by the provider, filled in by the reconciler
+	Successful   int        `json:"successful"`
+	Failed       int        `json:"failed"`
+	Errored      int        `json:"errored"`
+	Converted    int        `json:"converted"`
+	ReconciledAt *time.Time `gorm:"index" json:"reconciled_at,omitempty"`
+}
+
+// NotificationAttempt records one provider call made while delivering a notification
+type NotificationAttempt struct {
 	ID             uint      `gorm:"primarykey" json:"id"`
-	NotificationID string    `gorm:"uniqueIndex;not null" json:"notification_id"`
-	UserID         string    `gorm:"index;not null" json:"user_id"`
-	Status         string    `gorm:"not null" json:"status"` // delivered, pending, failed
+	NotificationID string    `gorm:"index;not null" json:"notification_id"`
+	Provider       string    `gorm:"type:varchar(50);not null" json:"provider"`
+	Devices        int       `json:"devices"`
 	Recipients     int       `json:"recipients"`
+	Fallback       bool      `json:"fallback"` // devices were failed over from another provider
+	Error          *string   `json:"error,omitempty"`
+	DurationMs     int64     `json:"duration_ms"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// NotificationDelivery is the outcome of a notification for one of the user's devices
+type NotificationDelivery struct {
+	ID                uint       `gorm:"primarykey" json:"id"`
+	NotificationID    string     `gorm:"uniqueIndex:idx_notification_deliveries_device;not null" json:"notification_id"`
+	DeviceID          uint       `gorm:"uniqueIndex:idx_notification_deliveries_device;not null" json:"device_id"`
+	Platform          string     `gorm:"type:varchar(50)" json:"platform"`
+	Provider          string     `gorm:"type:varchar(50)" json:"provider,omitempty"` // provider of the last attempt
+	ProviderMessageID string     `gorm:"index" json:"provider_message_id,omitempty"`
+	Status            string     `gorm:"not null" json:"status"`
+	ErrorCode         string     `gorm:"type:varchar(100)" json:"error_code,omitempty"` // provider error code, e.g. UNREGISTERED
+	Error             *string    `json:"error,omitempty"`
+	Attempts          int        `json:"attempts"` // provider calls made for this device, including failovers
+	SentAt            *time.Time `json:"sent_at,omitempty"`
+	DeliveredAt       *time.Time `json:"delivered_at,omitempty"` // displayed on the device
+	ClickedAt         *time.Time `json:"clicked_at,omitempty"`
+	DismissedAt       *time.Time `json:"dismissed_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// NotificationStatusChange is an append-only record of a notification's status transitions
+type NotificationStatusChange struct {
+	ID             uint      `gorm:"primarykey" json:"id"`
+	NotificationID string    `gorm:"index;not null" json:"notification_id"`
+	FromStatus     string    `gorm:"type:varchar(20)" json:"from_status,omitempty"` // empty for the first status
+	ToStatus       string    `gorm:"type:varchar(20);not null" json:"to_status"`
+	Source         string    `gorm:"type:varchar(50);not null" json:"source"` // send, api, ...
 	Error          *string   `json:"error,omitempty"`
 	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
 }
@@ -0,0 +1,234 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Connection states reported by ConnectionManager
+const (
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateClosed       = "closed"
+)
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+)
+
+// ErrNotConnected is returned while the broker connection is down and being re-established
+var ErrNotConnected = errors.New("rabbitmq connection is not available")
+
+// ConnectionStatus is a snapshot of the broker connection for health checks
+type ConnectionStatus struct {
+	State      string
+	Reconnects int       // successful reconnects since startup
+	LastError  string    // why the connection last dropped or failed to dial
+	Since      time.Time // when the current state was entered
+}
+
+// ConnectionManager owns the RabbitMQ connection. It watches NotifyClose and
+// redials with backoff when the broker goes away; consumers wait on Ready and
+// rebuild their channels, publishers get ErrNotConnected until it is back.
+type ConnectionManager struct {
+	url string
+
+	mu     sync.RWMutex
+	conn   *amqp091.Connection
+	ready  chan struct{} // closed while connected, replaced on disconnect
+	status ConnectionStatus
+	done   chan struct{}
+}
+
+func NewConnectionManager(url string) *ConnectionManager {
+	return &ConnectionManager{
+		url:    url,
+		ready:  make(chan struct{}),
+		status: ConnectionStatus{State: StateReconnecting, Since: time.Now()},
+		done:   make(chan struct{}),
+	}
+}
+
+// Connect dials the broker and starts watching the connection. The first dial
+// is not retried so a bad URL fails startup instead of looping forever.
+func (m *ConnectionManager) Connect() error {
+	conn, err := amqp091.Dial(m.url)
+	if err != nil {
+		m.setError(err)
+		return err
+	}
+	m.setConnected(conn, false)
+	go m.watch(conn)
+	return nil
+}
+
+// Channel opens a channel on the current connection
+func (m *ConnectionManager) Channel() (*amqp091.Channel, error) {
+	m.mu.RLock()
+	conn := m.conn
+	m.mu.RUnlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// Ready returns a channel that is closed once the connection is up
+func (m *ConnectionManager) Ready() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ready
+}
+
+// WaitReady blocks until the connection is up or ctx is cancelled
+func (m *ConnectionManager) WaitReady(ctx context.Context) error {
+	select {
+	case <-m.Ready():
+		return nil
+	case <-m.done:
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the current connection state
+func (m *ConnectionManager) Status() ConnectionStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// IsConnected reports whether the connection is currently usable
+func (m *ConnectionManager) IsConnected() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.conn != nil && !m.conn.IsClosed()
+}
+
+// Close stops reconnecting and closes the connection
+func (m *ConnectionManager) Close() error {
+	m.mu.Lock()
+	select {
+	case <-m.done:
+		m.mu.Unlock()
+		return nil
+	default:
+	}
+	close(m.done)
+	conn := m.conn
+	m.conn = nil
+	m.status = ConnectionStatus{State: StateClosed, Reconnects: m.status.Reconnects, Since: time.Now()}
+	m.mu.Unlock()
+
+	if conn != nil && !conn.IsClosed() {
+		return conn.Close()
+	}
+	return nil
+}
+
+// watch waits for the connection to drop and redials until it is back or the manager is closed
+func (m *ConnectionManager) watch(conn *amqp091.Connection) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp091.Error, 1))
+
+		select {
+		case <-m.done:
+			return
+		case amqpErr := <-closed:
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if amqpErr != nil {
+				log.Printf("RabbitMQ connection lost: %v. Reconnecting...", amqpErr)
+				m.setDisconnected(amqpErr)
+			} else {
+				log.Println("RabbitMQ connection closed. Reconnecting...")
+				m.setDisconnected(ErrNotConnected)
+			}
+		}
+
+		next, ok := m.redial()
+		if !ok {
+			return
+		}
+		conn = next
+	}
+}
+
+// redial dials with exponential, jittered backoff until it succeeds or Close is called
+func (m *ConnectionManager) redial() (*amqp091.Connection, bool) {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-m.done:
+			return nil, false
+		case <-time.After(wait):
+		}
+
+		conn, err := amqp091.Dial(m.url)
+		if err == nil {
+			log.Printf("Reconnected to RabbitMQ after %d attempt(s)", attempt)
+			m.setConnected(conn, true)
+			return conn, true
+		}
+
+		log.Printf("RabbitMQ reconnect attempt %d failed: %v", attempt, err)
+		m.setError(err)
+		if delay < reconnectMaxDelay {
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+		}
+	}
+}
+
+func (m *ConnectionManager) setConnected(conn *amqp091.Connection, reconnect bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.done:
+		// Closed while dialing, do not resurrect the connection
+		_ = conn.Close()
+		return
+	default:
+	}
+
+	m.conn = conn
+	m.status.State = StateConnected
+	m.status.Since = time.Now()
+	if reconnect {
+		m.status.Reconnects++
+	}
+	close(m.ready)
+}
+
+func (m *ConnectionManager) setDisconnected(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conn = nil
+	m.ready = make(chan struct{})
+	m.status.State = StateReconnecting
+	m.status.LastError = err.Error()
+	m.status.Since = time.Now()
+}
+
+func (m *ConnectionManager) setError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status.LastError = err.Error()
+}
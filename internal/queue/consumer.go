@@ -4,90 +4,258 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/rabbitmq/amqp091-go"
+	"github.com/whotterre/push_microservice/internal/apperrors"
 	"github.com/whotterre/push_microservice/internal/dto"
 )
 
+const (
+	PushSendQueue   = "push.send.queue"
+	PushTokensQueue = "push.tokens.queue"
+
+	// DeadLetterExchange routes failed messages to <queue>.dlq style parking-lot queues
+	DeadLetterExchange = "push.dlx"
+
+	HeaderFailureReason = "x-failure-reason"
+	HeaderFailedAt      = "x-failed-at"
+	HeaderOriginalQueue = "x-original-queue"
+
+	// HeaderDeadline is when a push with a ttl stops being worth sending. It is set on
+	// the first attempt and carried by retries so the ttl is not restarted.
+	HeaderDeadline = "x-deadline"
+
+	// HeaderNotificationID is the notification ID of a send request that carries none.
+	// It is set on the first attempt and carried by retries so all are claimed under it.
+	HeaderNotificationID = "x-notification-id"
+)
+
+// MaxMessagePriority is the x-max-priority push.send.queue is declared with so
+// transactional pushes overtake marketing bulk. The services publishing to it set
+// the priority per message, as documented in the README; a message without one is
+// treated as the lowest priority by the broker.
+const MaxMessagePriority uint8 = 10
+
+// priorityQueues lists the queues declared as priority queues, with their x-max-priority
+var priorityQueues = map[string]uint8{
+	PushSendQueue: MaxMessagePriority,
+}
+
+// deadLetterQueueName maps push.send.queue to push.send.dlq
+func deadLetterQueueName(queueName string) string {
+	return trimQueueSuffix(queueName) + ".dlq"
+}
+
+func trimQueueSuffix(queueName string) string {
+	return strings.TrimSuffix(queueName, ".queue")
+}
+
 type MessageProcessor interface {
-	ProcessSendMessage(message []byte) error
+	// ProcessSendMessage sends a push. notificationID stands in for a request without
+	// one. deadline is the one carried from an earlier attempt, zero on the first.
+	ProcessSendMessage(message []byte, correlationID, notificationID string, deadline time.Time) error
 	ProcessTokenMessage(message []byte) error
 }
 
 type PushConsumer struct {
-	conn    *amqp091.Connection
+	conn    *ConnectionManager
 	service MessageProcessor
 	workers int
+	retry   RetryPolicy
 }
 
-func NewPushConsumer(conn *amqp091.Connection, service MessageProcessor, workers int) *PushConsumer {
+func NewPushConsumer(conn *ConnectionManager, service MessageProcessor, workers int, retry RetryPolicy) *PushConsumer {
 	return &PushConsumer{
 		conn:    conn,
 		service: service,
 		workers: workers,
+		retry:   retry.withDefaults(),
 	}
 }
 
+// Consume starts a consumer per queue and keeps them running across broker
+// restarts: when any channel closes, all of them are torn down and rebuilt,
+// topology included, once the connection manager has reconnected.
 func (c *PushConsumer) Consume(ctx context.Context) error {
+	for {
+		if err := c.conn.WaitReady(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		channels, err := c.startConsumers()
+		if err != nil {
+			log.Printf("Failed to start consumers: %v. Retrying in %v...", err, reconnectMinDelay)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(reconnectMinDelay):
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down consumer...")
+			closeChannels(channels)
+			return nil
+		case amqpErr := <-notifyAnyClose(channels):
+			log.Printf("Consumer channel closed: %v. Restarting consumers...", amqpErr)
+			closeChannels(channels)
+		}
+	}
+}
+
+// startConsumers declares the topology and starts a consumer for every queue
+func (c *PushConsumer) startConsumers() ([]*amqp091.Channel, error) {
+	queues := map[string]func(*amqp091.Delivery) error{
+		PushSendQueue:   c.handleSendMessage,
+		PushTokensQueue: c.handleTokenMessage,
+	}
+
+	channels := make([]*amqp091.Channel, 0, len(queues))
+	for queueName, handler := range queues {
+		ch, err := c.setupQueueConsumer(queueName, handler)
+		if err != nil {
+			closeChannels(channels)
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, nil
+}
+
+func closeChannels(channels []*amqp091.Channel) {
+	for _, ch := range channels {
+		_ = ch.Close()
+	}
+}
+
+// notifyAnyClose fires once when the first of the channels closes
+func notifyAnyClose(channels []*amqp091.Channel) <-chan *amqp091.Error {
+	out := make(chan *amqp091.Error, len(channels))
+	for _, ch := range channels {
+		closed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+		go func() {
+			out <- <-closed
+		}()
+	}
+	return out
+}
+
+// declareTopology declares the dead-letter exchange, the queue's DLQ, its retry
+// delay queues and the queue itself with dead-lettering arguments. A queue that already exists with
+// different arguments makes the broker close the channel, so in that case the
+// existing queue is passively declared on a fresh channel and used as is.
+func (c *PushConsumer) declareTopology(queueName string) (*amqp091.Channel, error) {
+	dlq := deadLetterQueueName(queueName)
+
 	ch, err := c.conn.Channel()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Declare queues
-	queues := map[string]func(amqp091.Delivery) error{
-		"push.send.queue":        c.handleSendMessage,
-		"push.tokens.queue": c.handleTokenMessage,
+	if err := ch.ExchangeDeclare(DeadLetterExchange, "direct", true, false, false, false, nil); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	if _, err := ch.QueueDeclare(dlq, true, false, false, false, nil); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	if err := ch.QueueBind(dlq, dlq, DeadLetterExchange, false, nil); err != nil {
+		_ = ch.Close()
+		return nil, err
 	}
 
-	for queueName, handler := range queues {
-		if err := c.setupQueueConsumer(ch, queueName, handler); err != nil {
+	// Retry tiers hold messages until their per-message expiration, then dead-letter
+	// them back onto the main queue through the default exchange
+	for tier := 1; tier <= c.retry.tiers(); tier++ {
+		_, err := ch.QueueDeclare(retryQueueName(queueName, tier), true, false, false, false, amqp091.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		})
+		if err != nil {
 			_ = ch.Close()
-			return err
+			return nil, err
 		}
 	}
 
-	<-ctx.Done()
-	log.Println("Shutting down consumer...")
-	return ch.Close()
-}
-func (c *PushConsumer) setupQueueConsumer(ch *amqp091.Channel, queueName string, handler func(amqp091.Delivery) error) error {
+	args := amqp091.Table{
+		"x-dead-letter-exchange":    DeadLetterExchange,
+		"x-dead-letter-routing-key": dlq,
+	}
+	if maxPriority, ok := priorityQueues[queueName]; ok {
+		args["x-max-priority"] = int32(maxPriority)
+	}
+
 	// Try to declare queue with current settings
-	// If it fails due to existing queue with different args, just consume from existing queue
-	_, err := ch.QueueDeclare(
+	_, err = ch.QueueDeclare(
 		queueName, // name
 		true,      // durable
 		false,     // auto-delete
 		false,     // exclusive
 		false,     // no-wait
-		nil,       // arguments
+		args,
 	)
+	if err == nil {
+		return ch, nil
+	}
 
+	// If queue already exists with different args, try passive declare
+	log.Printf("Queue %s declaration failed: %v. Attempting passive declare...", queueName, err)
+	_ = ch.Close()
+	ch, err = c.conn.Channel()
 	if err != nil {
-		// If queue already exists with different args, try passive declare
-		log.Printf("Queue %s declaration failed: %v. Attempting passive declare...", queueName, err)
-		_, err = ch.QueueDeclarePassive(
-			queueName,
-			true,
-			false,
-			false,
-			false,
-			nil,
-		)
-		if err != nil {
-			log.Printf("Passive declare also failed. Queue may need manual deletion: %v", err)
-			return err
-		}
-		log.Printf("Using existing queue: %s", queueName)
+		return nil, err
+	}
+	_, err = ch.QueueDeclarePassive(
+		queueName,
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		log.Printf("Passive declare also failed. Queue may need manual deletion: %v", err)
+		_ = ch.Close()
+		return nil, err
+	}
+	log.Printf("Using existing queue: %s. Broker-side dead-lettering and message priority may not be configured on it; "+
+		"failed messages are still published to %s explicitly. Delete the queue to pick up the new arguments.", queueName, dlq)
+	return ch, nil
+}
+
+// setupQueueConsumer starts consuming queueName. A handler may add headers to the
+// delivery; they are kept when the message is retried.
+func (c *PushConsumer) setupQueueConsumer(queueName string, handler func(*amqp091.Delivery) error) (*amqp091.Channel, error) {
+	ch, err := c.declareTopology(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a prefetch limit the broker pushes the whole backlog to us at once and
+	// message priority no longer decides what is processed next
+	if err := ch.Qos(c.workers, 0, false); err != nil {
+		_ = ch.Close()
+		return nil, err
 	}
 
 	// Start consuming
 	msgs, err := ch.Consume(queueName, "", false, false, false, false, nil)
 	if err != nil {
-		return err
+		_ = ch.Close()
+		return nil, err
 	}
 
 	// Process messages with concurrency control
@@ -107,18 +275,20 @@ func (c *PushConsumer) setupQueueConsumer(ch *amqp091.Channel, queueName string,
 
 				log.Printf("[%s] Processing message from %s", correlationID, queueName)
 
-				if err := handler(delivery); err != nil {
+				if err := handler(&delivery); err != nil {
+					if errors.Is(err, apperrors.ErrConflict) {
+						// e.g. a notification cancelled or already finished: nothing is left to do
+						log.Printf("[%s] Dropping message after %v: %v", correlationID, time.Since(start), err)
+						_ = delivery.Ack(false)
+						return
+					}
 					log.Printf("[%s] Handler failed after %v: %v", correlationID, time.Since(start), err)
 
-					// Check if error is retryable
-					if isRetryableError(err) {
-						log.Printf("[%s] Retrying message (transient error)", correlationID)
-						// Requeue for retry
-						_ = delivery.Nack(false, true)
+					if apperrors.IsRetryable(err) {
+						c.scheduleRetry(ch, queueName, delivery, err)
 					} else {
-						log.Printf("[%s] Non-retryable error. Rejecting message without requeue.", correlationID)
-						// Reject without requeue (message will be discarded)
-						_ = delivery.Reject(false)
+						log.Printf("[%s] Non-retryable error. Moving message to %s.", correlationID, deadLetterQueueName(queueName))
+						c.deadLetter(ch, queueName, delivery, err)
 					}
 					return
 				}
@@ -130,39 +300,158 @@ func (c *PushConsumer) setupQueueConsumer(ch *amqp091.Channel, queueName string,
 	}()
 
 	log.Printf("Started consumer for queue: %s", queueName)
-	return nil
+	return ch, nil
 }
 
-func (c *PushConsumer) handleSendMessage(d amqp091.Delivery) error {
-	// Log raw message from queue
-	log.Printf("Raw message from queue: %s", string(d.Body))
+// scheduleRetry parks a message that failed with a transient error in a retry
+// tier with an exponential, jittered delay, or dead-letters it once the attempt
+// budget is spent. The original delivery is acked once the copy is published.
+func (c *PushConsumer) scheduleRetry(ch *amqp091.Channel, queueName string, delivery amqp091.Delivery, cause error) {
+	retry := retryCount(delivery.Headers) + 1
+	if retry >= c.retry.MaxAttempts {
+		log.Printf("[%s] Giving up after %d attempts. Moving message to %s.", delivery.CorrelationId, retry, deadLetterQueueName(queueName))
+		c.deadLetter(ch, queueName, delivery, fmt.Errorf("max retry attempts (%d) exceeded: %w", c.retry.MaxAttempts, cause))
+		return
+	}
 
+	headers := amqp091.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryCount] = int32(retry)
+	headers[HeaderFailureReason] = cause.Error()
+
+	delay := c.retry.backoff(retry)
+	tier := c.retry.tierFor(retry)
+
+	// Honour the provider's Retry-After when it asks for longer than our backoff
+	var rateLimitErr *apperrors.RateLimitError
+	if errors.As(cause, &rateLimitErr) && rateLimitErr.RetryAfter > delay {
+		delay = min(rateLimitErr.RetryAfter, c.retry.MaxDelay)
+		tier = max(tier, c.retry.tierForDelay(delay))
+	}
+	retryQueue := retryQueueName(queueName, tier)
+	log.Printf("[%s] Retrying message in %v via %s (attempt %d of %d)", delivery.CorrelationId, delay, retryQueue, retry+1, c.retry.MaxAttempts)
+
+	err := ch.Publish("", retryQueue, false, false, amqp091.Publishing{
+		Headers:       headers,
+		ContentType:   delivery.ContentType,
+		Body:          delivery.Body,
+		CorrelationId: delivery.CorrelationId,
+		MessageId:     delivery.MessageId,
+		DeliveryMode:  amqp091.Persistent,
+		Priority:      delivery.Priority, // kept when the retry is dead-lettered back onto the main queue
+		Timestamp:     delivery.Timestamp,
+		Expiration:    strconv.FormatInt(delay.Milliseconds(), 10),
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to schedule retry: %v. Requeueing immediately.", delivery.CorrelationId, err)
+		_ = delivery.Nack(false, true)
+		return
+	}
+	_ = delivery.Ack(false)
+}
+
+// deadLetter publishes a failed message to the queue's DLQ annotated with why it
+// failed, then acks the original. If that publish fails the message is rejected
+// so the broker dead-letters it through the queue's x-dead-letter-exchange instead.
+func (c *PushConsumer) deadLetter(ch *amqp091.Channel, queueName string, delivery amqp091.Delivery, cause error) {
+	headers := amqp091.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	headers[HeaderFailureReason] = cause.Error()
+	headers[HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339)
+	headers[HeaderOriginalQueue] = queueName
+
+	dlq := deadLetterQueueName(queueName)
+	err := ch.Publish(DeadLetterExchange, dlq, false, false, amqp091.Publishing{
+		Headers:       headers,
+		ContentType:   delivery.ContentType,
+		Body:          delivery.Body,
+		CorrelationId: delivery.CorrelationId,
+		MessageId:     delivery.MessageId,
+		DeliveryMode:  amqp091.Persistent,
+		Priority:      delivery.Priority,
+		Timestamp:     delivery.Timestamp,
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to publish to %s: %v. Rejecting for broker dead-lettering.", delivery.CorrelationId, dlq, err)
+		_ = delivery.Reject(false)
+		return
+	}
+	_ = delivery.Ack(false)
+}
+
+func (c *PushConsumer) handleSendMessage(d *amqp091.Delivery) error {
 	var req dto.PushRequest
 	if err := json.Unmarshal(d.Body, &req); err != nil {
-		log.Printf("Failed to unmarshal message: %v", err)
-		return err
+		log.Printf("[%s] Failed to unmarshal message: %v", d.CorrelationId, err)
+		return apperrors.Validation("invalid message format: %w", err)
 	}
 
-	// Log parsed request
-	log.Printf("Parsed PushRequest - UserID: %s, Title: '%s', Message: '%s'",
-		req.UserID, req.Title, req.Message)
-
 	// Use correlation ID from message if available
 	if d.CorrelationId != "" {
 		req.CorrelationID = d.CorrelationId
 	}
 
-	return c.service.ProcessSendMessage(d.Body)
+	notificationID := sendNotificationID(d, req.NotificationID)
+
+	// Only identifiers are logged: the content and data may carry personal information
+	log.Printf("[%s] Parsed PushRequest - NotificationID: %s, UserID: %s",
+		req.CorrelationID, notificationID, req.UserID)
+
+	return c.service.ProcessSendMessage(d.Body, req.CorrelationID, notificationID, sendDeadline(d, req.TTL))
 }
 
-func (c *PushConsumer) handleTokenMessage(d amqp091.Delivery) error {
-	// Log raw message from queue
-	log.Printf("Raw token update message: %s", string(d.Body))
+// sendNotificationID returns the notification ID of a send request. A request without
+// one gets the ID stamped on the delivery by an earlier attempt, or else one derived
+// from the AMQP message ID, so a redelivery is claimed under the same ID, or a new one.
+// It is stamped on the delivery's headers for retries.
+func sendNotificationID(d *amqp091.Delivery, id string) string {
+	if id != "" {
+		return id
+	}
+	if v, ok := d.Headers[HeaderNotificationID].(string); ok && v != "" {
+		return v
+	}
+	if d.MessageId != "" {
+		id = uuid.NewSHA1(uuid.NameSpaceOID, []byte(d.MessageId)).String()
+	} else {
+		id = uuid.New().String()
+	}
+	if d.Headers == nil {
+		d.Headers = amqp091.Table{}
+	}
+	d.Headers[HeaderNotificationID] = id
+	return id
+}
 
+// sendDeadline returns the deadline carried by a retried delivery. On the first
+// attempt it returns zero and stamps now plus the ttl on the delivery's headers.
+func sendDeadline(d *amqp091.Delivery, ttl *int) time.Time {
+	if v, ok := d.Headers[HeaderDeadline].(string); ok {
+		deadline, err := time.Parse(time.RFC3339Nano, v)
+		if err == nil {
+			return deadline
+		}
+		log.Printf("[%s] Ignoring invalid %s header %q: %v", d.CorrelationId, HeaderDeadline, v, err)
+	}
+	if ttl != nil {
+		if d.Headers == nil {
+			d.Headers = amqp091.Table{}
+		}
+		deadline := time.Now().Add(time.Duration(*ttl) * time.Second)
+		d.Headers[HeaderDeadline] = deadline.UTC().Format(time.RFC3339Nano)
+	}
+	return time.Time{}
+}
+
+func (c *PushConsumer) handleTokenMessage(d *amqp091.Delivery) error {
 	var req dto.TokenUpdate
 	if err := json.Unmarshal(d.Body, &req); err != nil {
 		log.Printf("Failed to unmarshal token update: %v", err)
-		return err
+		return apperrors.Validation("invalid message format: %w", err)
 	}
 
 	log.Printf("Parsed TokenUpdate - UserID: %s, PlayerID: %s, Platform: %s",
@@ -177,44 +466,3 @@ func (c *PushConsumer) Close() error {
 	}
 	return nil
 }
-
-// isRetryableError determines if an error should trigger a retry
-func isRetryableError(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	errMsg := err.Error()
-
-	// Non-retryable errors (business logic failures)
-	nonRetryableErrors := []string{
-		"no active devices for user",
-		"invalid message format",
-		"user not found",
-		"invalid player id",
-	}
-
-	for _, nonRetryable := range nonRetryableErrors {
-		if strings.Contains(strings.ToLower(errMsg), nonRetryable) {
-			return false
-		}
-	}
-
-	// Retryable errors (transient failures)
-	retryableErrors := []string{
-		"connection refused",
-		"timeout",
-		"temporary failure",
-		"database connection",
-		"context deadline exceeded",
-	}
-
-	for _, retryable := range retryableErrors {
-		if strings.Contains(strings.ToLower(errMsg), retryable) {
-			return true
-		}
-	}
-
-	// Default: don't retry unknown errors to avoid infinite loops
-	return false
-}
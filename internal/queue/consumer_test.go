@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestSendDeadlineIsStampedOnFirstAttempt(t *testing.T) {
+	ttl := 60
+	d := &amqp091.Delivery{}
+
+	if deadline := sendDeadline(d, &ttl); !deadline.IsZero() {
+		t.Errorf("first attempt deadline = %v, want zero so the full ttl is used", deadline)
+	}
+	stamped, ok := d.Headers[HeaderDeadline].(string)
+	if !ok {
+		t.Fatalf("headers = %v, want %s stamped for retries", d.Headers, HeaderDeadline)
+	}
+
+	// A retry carries the copied headers and gets the original deadline back
+	retry := &amqp091.Delivery{Headers: amqp091.Table{HeaderDeadline: stamped}}
+	deadline := sendDeadline(retry, &ttl)
+	if remaining := time.Until(deadline); remaining <= 55*time.Second || remaining > time.Minute {
+		t.Errorf("retry deadline is %v away, want the original one about a minute away", remaining)
+	}
+}
+
+func TestSendDeadlineWithoutTTL(t *testing.T) {
+	d := &amqp091.Delivery{}
+	if deadline := sendDeadline(d, nil); !deadline.IsZero() || d.Headers != nil {
+		t.Errorf("deadline = %v, headers = %v, want neither without a ttl", deadline, d.Headers)
+	}
+}
+
+func TestSendNotificationID(t *testing.T) {
+	if id := sendNotificationID(&amqp091.Delivery{}, "notif-1"); id != "notif-1" {
+		t.Errorf("id = %q, want the request's own", id)
+	}
+
+	// A request without one gets the same ID on a redelivery and on a retry
+	first := sendNotificationID(&amqp091.Delivery{MessageId: "msg-1"}, "")
+	if again := sendNotificationID(&amqp091.Delivery{MessageId: "msg-1"}, ""); again != first || first == "" {
+		t.Errorf("ids %q and %q, want one derived from the message ID", first, again)
+	}
+	d := &amqp091.Delivery{}
+	generated := sendNotificationID(d, "")
+	retry := &amqp091.Delivery{Headers: amqp091.Table{HeaderNotificationID: d.Headers[HeaderNotificationID]}}
+	if id := sendNotificationID(retry, ""); id != generated || id == "" {
+		t.Errorf("retry id = %q, want the stamped %q", id, generated)
+	}
+}
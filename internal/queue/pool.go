@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// confirmChannel is a channel in publisher confirm mode together with the
+// listener for messages the broker returned as unroutable
+type confirmChannel struct {
+	ch      *amqp091.Channel
+	returns chan amqp091.Return
+}
+
+// channelPool hands out long-lived confirm-mode channels, one publish at a time
+// per channel so a basic.return can be matched to the publish that caused it
+type channelPool struct {
+	conn *ConnectionManager
+	sem  chan struct{} // bounds the number of open channels
+
+	mu   sync.Mutex
+	idle []*confirmChannel
+}
+
+func newChannelPool(conn *ConnectionManager, size int) *channelPool {
+	return &channelPool{
+		conn: conn,
+		sem:  make(chan struct{}, size),
+	}
+}
+
+// get returns an idle channel, opening a new one when the pool is not yet full
+func (p *channelPool) get(ctx context.Context) (*confirmChannel, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		cc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !cc.ch.IsClosed() {
+			p.mu.Unlock()
+			return cc, nil
+		}
+	}
+	p.mu.Unlock()
+
+	cc, err := p.open()
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return cc, nil
+}
+
+// put hands a channel back. Channels left in an unknown state, e.g. after a
+// confirm timeout, are closed rather than reused.
+func (p *channelPool) put(cc *confirmChannel, reusable bool) {
+	if reusable && !cc.ch.IsClosed() {
+		p.mu.Lock()
+		p.idle = append(p.idle, cc)
+		p.mu.Unlock()
+	} else {
+		_ = cc.ch.Close()
+	}
+	<-p.sem
+}
+
+func (p *channelPool) open() (*confirmChannel, error) {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	return &confirmChannel{
+		ch:      ch,
+		returns: ch.NotifyReturn(make(chan amqp091.Return, 1)),
+	}, nil
+}
+
+// close closes every idle channel
+func (p *channelPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, cc := range p.idle {
+		_ = cc.ch.Close()
+	}
+	p.idle = nil
+}
@@ -1,73 +1,226 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/rabbitmq/amqp091-go"
 )
 
+var (
+	// ErrUnroutable is returned when the broker had no queue to route a mandatory publish to
+	ErrUnroutable = errors.New("message was returned as unroutable")
+	// ErrNacked is returned when the broker refused to take responsibility for a message
+	ErrNacked = errors.New("message was nacked by the broker")
+	// ErrUnknownDestination is returned for a destination missing from the routing table
+	ErrUnknownDestination = errors.New("no publish route for destination")
+)
+
 type PushProducer interface {
-	PublishMessage(queueName string, message interface{}, correlationID string) error
+	PublishMessage(destination string, message interface{}, correlationID string) error
 	PublishToUserService(message interface{}, correlationID string) error
 	PublishToEmailService(message interface{}, correlationID string) error
 	PublishToTemplateService(message interface{}, correlationID string) error
+	NewStatusEvent(status string, event interface{}, correlationID string) (*Envelope, error)
+	PublishEnvelope(env *Envelope) error
+}
+
+// Envelope is a fully built message: where it goes and what it carries. Envelopes
+// are what the outbox stores, so a relayed message keeps its original message ID.
+type Envelope struct {
+	Exchange      string
+	RoutingKey    string
+	MessageID     string
+	CorrelationID string
+	Body          []byte
+}
+
+// PublisherOptions controls where the producer publishes, its channel pool and confirm handling
+type PublisherOptions struct {
+	Exchange       string            // topic exchange every message is published through
+	Routes         map[string]string // destination service -> routing key
+	StatusExchange string            // topic exchange delivery status events are published to
+	PoolSize       int               // long-lived confirm channels kept open
+	ConfirmTimeout time.Duration     // how long to wait for the broker's ack
+}
+
+// DefaultPublisherOptions is used when no publisher settings are configured
+var DefaultPublisherOptions = PublisherOptions{
+	Exchange:       DefaultPublishExchange,
+	StatusExchange: DefaultStatusExchange,
+	PoolSize:       4,
+	ConfirmTimeout: 5 * time.Second,
+}
+
+// withDefaults fills unset fields from DefaultPublisherOptions
+func (o PublisherOptions) withDefaults() PublisherOptions {
+	if o.Exchange == "" {
+		o.Exchange = DefaultPublisherOptions.Exchange
+	}
+	if o.StatusExchange == "" {
+		o.StatusExchange = DefaultPublisherOptions.StatusExchange
+	}
+	if len(o.Routes) == 0 {
+		o.Routes, _ = ParsePublishRoutes(DefaultPublishRoutes)
+	}
+	if o.PoolSize <= 0 {
+		o.PoolSize = DefaultPublisherOptions.PoolSize
+	}
+	if o.ConfirmTimeout <= 0 {
+		o.ConfirmTimeout = DefaultPublisherOptions.ConfirmTimeout
+	}
+	return o
 }
 
 type pushProducer struct {
-	conn *amqp091.Connection
+	conn *ConnectionManager
+	pool *channelPool
+	opts PublisherOptions
+
+	mu          sync.Mutex
+	declaredFor int // connection generation the topology was last declared on, 0 for never
 }
 
-func NewPushProducer(conn *amqp091.Connection) PushProducer {
+func NewPushProducer(conn *ConnectionManager, opts PublisherOptions) PushProducer {
+	opts = opts.withDefaults()
 	return &pushProducer{
 		conn: conn,
+		pool: newChannelPool(conn, opts.PoolSize),
+		opts: opts,
 	}
 }
 
-// Generic method to publish to any queue
-func (p *pushProducer) PublishMessage(queueName string, message interface{}, correlationID string) error {
-	ch, err := p.conn.Channel()
-	if err != nil {
-		return err
+// PublishMessage publishes to a destination service through the publish exchange
+// as a persistent, mandatory message and returns only once the broker has confirmed
+// it. Unroutable and nacked messages and confirm timeouts are reported as errors.
+func (p *pushProducer) PublishMessage(destination string, message interface{}, correlationID string) error {
+	routingKey, ok := p.opts.Routes[destination]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownDestination, destination)
 	}
-	defer ch.Close()
 
-	// Declare queue (idempotent)
-	_, err = ch.QueueDeclare(queueName, true, false, false, false, nil)
+	env, err := newEnvelope(p.opts.Exchange, routingKey, message, correlationID)
 	if err != nil {
 		return err
 	}
+	return p.PublishEnvelope(env)
+}
+
+// NewStatusEvent builds a delivery status event for the status exchange with
+// routing key push.<status>. It is not published until passed to PublishEnvelope.
+func (p *pushProducer) NewStatusEvent(status string, event interface{}, correlationID string) (*Envelope, error) {
+	return newEnvelope(p.opts.StatusExchange, statusRoutingKey(status), event, correlationID)
+}
 
+func newEnvelope(exchange, routingKey string, message interface{}, correlationID string) (*Envelope, error) {
 	// Marshal message to JSON
 	body, err := json.Marshal(message)
 	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Exchange:      exchange,
+		RoutingKey:    routingKey,
+		MessageID:     uuid.New().String(),
+		CorrelationID: correlationID,
+		Body:          body,
+	}, nil
+}
+
+// PublishEnvelope publishes a prebuilt message and waits for the broker's confirm
+func (p *pushProducer) PublishEnvelope(env *Envelope) error {
+	if err := p.ensureTopology(); err != nil {
 		return err
 	}
 
-	// Publish message
-	return ch.Publish("", queueName, false, false,
-		amqp091.Publishing{
-			ContentType:   "application/json",
-			Body:          body,
-			CorrelationId: correlationID,
-			DeliveryMode:  amqp091.Persistent,
-		},
-	)
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.ConfirmTimeout)
+	defer cancel()
+
+	cc, err := p.pool.get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get publish channel: %w", err)
+	}
+
+	reusable, err := p.publish(ctx, cc, env.Exchange, env.RoutingKey, amqp091.Publishing{
+		ContentType:   "application/json",
+		Body:          env.Body,
+		CorrelationId: env.CorrelationID,
+		MessageId:     env.MessageID,
+		DeliveryMode:  amqp091.Persistent,
+		Timestamp:     time.Now().UTC(),
+	})
+	p.pool.put(cc, reusable)
+	return err
+}
+
+// publish sends one message on a pooled channel and waits for its confirm.
+// It reports whether the channel can be handed back to the pool.
+func (p *pushProducer) publish(ctx context.Context, cc *confirmChannel, exchange, routingKey string, msg amqp091.Publishing) (bool, error) {
+	confirm, err := cc.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, true, false, msg)
+	if err != nil {
+		return false, fmt.Errorf("failed to publish to %s: %w", routingKey, err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		// A late ack may still arrive on this channel, so it is not reused
+		return false, fmt.Errorf("timed out waiting for confirm from %s: %w", routingKey, err)
+	}
+
+	// The broker sends basic.return before the ack of the same message, so any
+	// return for this publish is already buffered by now
+	select {
+	case ret := <-cc.returns:
+		return true, fmt.Errorf("%w: %s to %s (%d %s)", ErrUnroutable, ret.MessageId, routingKey, ret.ReplyCode, ret.ReplyText)
+	default:
+	}
+
+	if !acked {
+		return true, fmt.Errorf("%w: publish to %s", ErrNacked, routingKey)
+	}
+	return true, nil
+}
+
+// ensureTopology declares the exchanges, destination queues and bindings once per
+// connection, so they are redeclared after the connection manager reconnects
+func (p *pushProducer) ensureTopology() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	generation := p.conn.Status().Reconnects + 1
+	if p.declaredFor == generation {
+		return nil
+	}
+	if err := declarePublishTopology(p.conn, p.opts.Exchange, p.opts.Routes); err != nil {
+		return err
+	}
+	if err := declareStatusTopology(p.conn, p.opts.StatusExchange); err != nil {
+		return err
+	}
+	p.declaredFor = generation
+	return nil
 }
 
-// Convenience methods for other queues
+// Convenience methods for other services
 func (p *pushProducer) PublishToUserService(message interface{}, correlationID string) error {
-	return p.PublishMessage("user.send.queue", message, correlationID)
+	return p.PublishMessage(DestinationUser, message, correlationID)
 }
 
 func (p *pushProducer) PublishToEmailService(message interface{}, correlationID string) error {
-	return p.PublishMessage("user.send.queue", message, correlationID)
+	return p.PublishMessage(DestinationEmail, message, correlationID)
 }
 
 func (p *pushProducer) PublishToTemplateService(message interface{}, correlationID string) error {
-	return p.PublishMessage("template.send.queue", message, correlationID)
+	return p.PublishMessage(DestinationTemplate, message, correlationID)
 }
 
 func (p *pushProducer) Close() error {
+	p.pool.close()
 	if p.conn != nil {
 		return p.conn.Close()
 	}
@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderRetryCount = "x-retry-count"
+
+	// maxRetryTiers caps how many delay queues are declared per main queue
+	maxRetryTiers = 10
+)
+
+// RetryPolicy controls delayed redelivery of messages that failed with a transient error
+type RetryPolicy struct {
+	MaxAttempts int           // total processing attempts before a message is dead-lettered
+	BaseDelay   time.Duration // delay before the first retry, doubled on each further attempt
+	MaxDelay    time.Duration // upper bound for a single delay
+}
+
+// DefaultRetryPolicy is used when no retry settings are configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+// withDefaults fills unset fields from DefaultRetryPolicy
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	return p
+}
+
+// tiers returns how many retry queues a main queue needs
+func (p RetryPolicy) tiers() int {
+	n := p.MaxAttempts - 1
+	if n > maxRetryTiers {
+		n = maxRetryTiers
+	}
+	return n
+}
+
+// tierDelay is the nominal delay of a tier: BaseDelay * 2^(tier-1), capped at MaxDelay
+func (p RetryPolicy) tierDelay(tier int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < tier && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// backoff returns the jittered delay before retry number retry (1-based).
+// Equal jitter keeps every message in a tier between half and the full tier
+// delay, so per-message expirations inside one queue never block each other for long.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.tierDelay(retry)
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// tierFor maps a retry number onto its delay queue, reusing the last tier once exhausted
+func (p RetryPolicy) tierFor(retry int) int {
+	if retry > p.tiers() {
+		return p.tiers()
+	}
+	return retry
+}
+
+// tierForDelay returns the first tier whose nominal delay covers d, so a message
+// held back longer than its attempt's tier does not sit ahead of shorter expirations
+func (p RetryPolicy) tierForDelay(d time.Duration) int {
+	for tier := 1; tier < p.tiers(); tier++ {
+		if p.tierDelay(tier) >= d {
+			return tier
+		}
+	}
+	return p.tiers()
+}
+
+// retryQueueName maps push.send.queue and tier 2 to push.send.retry.2
+func retryQueueName(queueName string, tier int) string {
+	return fmt.Sprintf("%s.retry.%d", trimQueueSuffix(queueName), tier)
+}
+
+// retryCount reads the x-retry-count header, tolerating the integer types AMQP may decode to
+func retryCount(headers amqp091.Table) int {
+	switch v := headers[HeaderRetryCount].(type) {
+	case int:
+		return v
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	}
+	return 0
+}
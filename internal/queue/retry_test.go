@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: time.Second}.withDefaults()
+	if p.MaxAttempts != DefaultRetryPolicy.MaxAttempts {
+		t.Errorf("MaxAttempts = %d, want the default %d", p.MaxAttempts, DefaultRetryPolicy.MaxAttempts)
+	}
+	if p.MaxDelay != p.BaseDelay {
+		t.Errorf("MaxDelay = %v, want it raised to BaseDelay %v", p.MaxDelay, p.BaseDelay)
+	}
+}
+
+func TestRetryPolicyTiers(t *testing.T) {
+	tests := []struct {
+		maxAttempts int
+		want        int
+	}{
+		{maxAttempts: 1, want: 0},
+		{maxAttempts: 5, want: 4},
+		{maxAttempts: 50, want: maxRetryTiers},
+	}
+	for _, tt := range tests {
+		if got := (RetryPolicy{MaxAttempts: tt.maxAttempts}).tiers(); got != tt.want {
+			t.Errorf("tiers() with %d attempts = %d, want %d", tt.maxAttempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyTierDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: 2 * time.Second, MaxDelay: 30 * time.Second}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, delay := range want {
+		if got := p.tierDelay(i + 1); got != delay {
+			t.Errorf("tierDelay(%d) = %v, want %v", i+1, got, delay)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffStaysWithinEqualJitter(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 2 * time.Second, MaxDelay: time.Minute}
+	for retry := 1; retry <= 4; retry++ {
+		nominal := p.tierDelay(retry)
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(retry); got < nominal/2 || got > nominal {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", retry, got, nominal/2, nominal)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyTierSelection(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 2 * time.Second, MaxDelay: time.Minute}
+
+	for retry, want := range map[int]int{1: 1, 3: 3, 4: 4, 7: 4} {
+		if got := p.tierFor(retry); got != want {
+			t.Errorf("tierFor(%d) = %d, want %d", retry, got, want)
+		}
+	}
+
+	// Tiers are 2s, 4s, 8s and 16s; a Retry-After picks the first tier long enough
+	for delay, want := range map[time.Duration]int{time.Second: 1, 3 * time.Second: 2, 8 * time.Second: 3, 10 * time.Second: 4, time.Hour: 4} {
+		if got := p.tierForDelay(delay); got != want {
+			t.Errorf("tierForDelay(%v) = %d, want %d", delay, got, want)
+		}
+	}
+}
+
+func TestRetryQueueName(t *testing.T) {
+	if got := retryQueueName(PushSendQueue, 2); got != "push.send.retry.2" {
+		t.Errorf("retryQueueName = %q, want push.send.retry.2", got)
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	tests := []struct {
+		headers amqp091.Table
+		want    int
+	}{
+		{headers: nil, want: 0},
+		{headers: amqp091.Table{HeaderRetryCount: int32(3)}, want: 3},
+		{headers: amqp091.Table{HeaderRetryCount: int64(4)}, want: 4},
+		{headers: amqp091.Table{HeaderRetryCount: int16(2)}, want: 2},
+		{headers: amqp091.Table{HeaderRetryCount: "3"}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := retryCount(tt.headers); got != tt.want {
+			t.Errorf("retryCount(%v) = %d, want %d", tt.headers, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package queue
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Destination services the producer publishes to
+const (
+	DestinationUser     = "user"
+	DestinationEmail    = "email"
+	DestinationTemplate = "template"
+)
+
+// DefaultPublishExchange is the topic exchange outbound messages go through
+const DefaultPublishExchange = "notifications.direct"
+
+// DefaultStatusExchange is the topic exchange delivery status events are published to,
+// with routing keys of the form push.<status>
+const DefaultStatusExchange = "notification.status"
+
+// StatusEventsQueue is bound to every status event so events are kept until a consumer reads them
+const StatusEventsQueue = "notification.status.queue"
+
+// DefaultPublishRoutes routes each destination to its service's send queue
+const DefaultPublishRoutes = "user=user.send;email=email.send;template=template.send"
+
+// ParsePublishRoutes parses a PUBLISH_ROUTES spec such as
+// "user=user.send;email=email.send;template=template.send" into destination -> routing key.
+// Each routing key is bound to a durable queue of the same name with a ".queue" suffix.
+func ParsePublishRoutes(spec string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		destination, key, ok := strings.Cut(rule, "=")
+		destination = strings.ToLower(strings.TrimSpace(destination))
+		key = strings.TrimSpace(key)
+		if !ok || destination == "" || key == "" {
+			return nil, fmt.Errorf("invalid publish route %q: expected destination=routing.key", rule)
+		}
+		if strings.ContainsAny(key, "*#") {
+			return nil, fmt.Errorf("invalid publish route %q: routing key must not contain wildcards", rule)
+		}
+		routes[destination] = key
+	}
+	return routes, nil
+}
+
+// boundQueueName maps routing key email.send to email.send.queue
+func boundQueueName(routingKey string) string {
+	return routingKey + ".queue"
+}
+
+// declarePublishTopology declares the publish exchange and a queue bound to every
+// route's routing key. A destination queue that its owning service already declared
+// with different arguments is left as is and only bound, the same way the consumer
+// falls back for its own queues.
+func declarePublishTopology(conn *ConnectionManager, exchange string, routes map[string]string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ch.Close() }()
+
+	if err := ch.ExchangeDeclare(exchange, "topic", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+	}
+
+	destinations := make([]string, 0, len(routes))
+	for destination := range routes {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+
+	for _, destination := range destinations {
+		key := routes[destination]
+		queueName := boundQueueName(key)
+		if _, err := ch.QueueDeclare(queueName, true, false, false, false, nil); err != nil {
+			log.Printf("Queue %s declaration failed: %v. Binding the existing queue as is...", queueName, err)
+			// The failed declare closed the channel
+			if ch, err = conn.Channel(); err != nil {
+				return err
+			}
+		}
+		if err := ch.QueueBind(queueName, key, exchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind %s to %s: %w", queueName, exchange, err)
+		}
+	}
+	return nil
+}
+
+// declareStatusTopology declares the status exchange and the queue collecting every event
+func declareStatusTopology(conn *ConnectionManager, exchange string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ch.Close() }()
+
+	if err := ch.ExchangeDeclare(exchange, "topic", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+	}
+	if _, err := ch.QueueDeclare(StatusEventsQueue, true, false, false, false, nil); err != nil {
+		log.Printf("Queue %s declaration failed: %v. Binding the existing queue as is...", StatusEventsQueue, err)
+		if ch, err = conn.Channel(); err != nil {
+			return err
+		}
+	}
+	if err := ch.QueueBind(StatusEventsQueue, "#", exchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind %s to %s: %w", StatusEventsQueue, exchange, err)
+	}
+	return nil
+}
+
+// statusRoutingKey maps status failed to push.failed
+func statusRoutingKey(status string) string {
+	return "push." + status
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePublishRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "default routes",
+			spec: DefaultPublishRoutes,
+			want: map[string]string{DestinationUser: "user.send", DestinationEmail: "email.send", DestinationTemplate: "template.send"},
+		},
+		{
+			name: "whitespace, case and empty rules",
+			spec: " Email = email.send.v2 ;; user=user.send; ",
+			want: map[string]string{DestinationEmail: "email.send.v2", DestinationUser: "user.send"},
+		},
+		{name: "empty spec", spec: "", want: map[string]string{}},
+		{name: "missing routing key", spec: "email=", wantErr: true},
+		{name: "missing destination", spec: "=email.send", wantErr: true},
+		{name: "no separator", spec: "email.send", wantErr: true},
+		{name: "wildcard routing key", spec: "email=email.*", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePublishRoutes(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePublishRoutes(%q) = %v, want an error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePublishRoutes(%q): %v", tt.spec, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePublishRoutes(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoundQueueName(t *testing.T) {
+	if got := boundQueueName("email.send"); got != "email.send.queue" {
+		t.Errorf("boundQueueName = %q, want email.send.queue", got)
+	}
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyRepository claims notification IDs before they are sent. The
+// Postgres implementation relies on the primary key; any store with an atomic
+// insert-if-absent (e.g. Redis SET NX) can implement it.
+type IdempotencyRepository interface {
+	Claim(key string, lease time.Duration) (*models.IdempotencyKey, bool, error)
+	Complete(key string, response string) error
+	Release(key string) error
+}
+
+type idempotencyRepository struct {
+	db *gorm.DB
+}
+
+func NewIdempotencyRepository(db *gorm.DB) IdempotencyRepository {
+	return &idempotencyRepository{
+		db: db,
+	}
+}
+
+// Claim takes the key for the caller. It returns the stored record and false when
+// the key is already completed or held by another worker whose lease is still
+// running. A processing claim older than lease is assumed abandoned and taken over.
+func (r *idempotencyRepository) Claim(key string, lease time.Duration) (*models.IdempotencyKey, bool, error) {
+	now := time.Now()
+	claim := &models.IdempotencyKey{Key: key, Status: models.IdempotencyProcessing, ClaimedAt: now}
+
+	res := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(claim)
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return claim, true, nil
+	}
+
+	var existing models.IdempotencyKey
+	if err := r.db.Where("key = ?", key).First(&existing).Error; err != nil {
+		return nil, false, err
+	}
+	if existing.Status == models.IdempotencyCompleted || now.Sub(existing.ClaimedAt) < lease {
+		return &existing, false, nil
+	}
+
+	// Compare-and-swap on claimed_at so only one worker takes over a stale claim
+	res = r.db.Model(&models.IdempotencyKey{}).
+		Where("key = ? AND status = ? AND claimed_at = ?", key, models.IdempotencyProcessing, existing.ClaimedAt).
+		Update("claimed_at", now)
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &existing, false, nil
+	}
+	existing.ClaimedAt = now
+	return &existing, true, nil
+}
+
+// Complete stores the result of the send under the key
+func (r *idempotencyRepository) Complete(key string, response string) error {
+	now := time.Now()
+	return r.db.Model(&models.IdempotencyKey{}).Where("key = ?", key).Updates(map[string]interface{}{
+		"status":       models.IdempotencyCompleted,
+		"response":     response,
+		"completed_at": now,
+	}).Error
+}
+
+// Release drops a claim whose send failed before anything was delivered, so a retry may send
+func (r *idempotencyRepository) Release(key string) error {
+	return r.db.Where("key = ? AND status = ?", key, models.IdempotencyProcessing).Delete(&models.IdempotencyKey{}).Error
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OutboxRepository interface {
+	DispatchPending(limit int, publish func(msg *models.OutboxMessage) error) (int, error)
+}
+
+type outboxRepository struct {
+	db *gorm.DB
+}
+
+func NewOutboxRepository(db *gorm.DB) OutboxRepository {
+	return &outboxRepository{
+		db: db,
+	}
+}
+
+// DispatchPending locks up to limit undispatched messages, oldest first, and hands
+// each to publish. Published messages are marked dispatched; the batch stops at the
+// first failure so events keep their order, and the failure is recorded on the row.
+// Rows locked by another relay instance are skipped.
+func (r *outboxRepository) DispatchPending(limit int, publish func(msg *models.OutboxMessage) error) (int, error) {
+	dispatched := 0
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var pending []models.OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("dispatched_at IS NULL").
+			Order("id").
+			Limit(limit).
+			Find(&pending).Error
+		if err != nil {
+			return err
+		}
+
+		for i := range pending {
+			msg := &pending[i]
+			if err := publish(msg); err != nil {
+				errMsg := err.Error()
+				return tx.Model(msg).Updates(map[string]interface{}{
+					"attempts":   gorm.Expr("attempts + 1"),
+					"last_error": errMsg,
+				}).Error
+			}
+
+			now := time.Now()
+			if err := tx.Model(msg).Updates(map[string]interface{}{
+				"attempts":      gorm.Expr("attempts + 1"),
+				"dispatched_at": now,
+			}).Error; err != nil {
+				// Already published: the relay will publish it again, consumers dedupe on message_id
+				return err
+			}
+			dispatched++
+		}
+		return nil
+	})
+	return dispatched, err
+}
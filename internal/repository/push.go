@@ -1,18 +1,39 @@
 package repository
 
 import (
+	"time"
+
 	"github.com/whotterre/push_microservice/internal/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PushRepository interface {
 	GetActiveDevicesByUserID(userID string) ([]models.UserDevice, error)
 	GetDeviceByPlayerID(playerID string) (*models.UserDevice, error)
+	GetDeviceByToken(provider, token string) (*models.UserDevice, error)
 	CreateDevice(device *models.UserDevice) error
 	UpdateDevice(device *models.UserDevice) error
+	DeactivateDevicesByPlayerIDs(playerIDs []string) error
+	DeactivateDevicesByTokens(provider string, tokens []string) error
 	CreateNotificationLog(log *models.NotificationLog) error
 	UpdateNotificationLog(log *models.NotificationLog) error
+	TransitionNotificationLog(log *models.NotificationLog, from string) (bool, error)
+	CreateStatusChange(change *models.NotificationStatusChange) error
+	GetStatusHistory(notificationID string) ([]models.NotificationStatusChange, error)
 	GetNotificationLog(notificationID string) (*models.NotificationLog, error)
+	GetNotificationsToReconcile(kind, provider string, limit int) ([]models.NotificationLog, error)
+	GetStaleNotifications(kind string, statuses []string, before time.Time, limit int) ([]models.NotificationLog, error)
+	GetStaleSentNotifications(kind, provider string, before time.Time, limit int) ([]models.NotificationLog, error)
+	UpdateNotificationCounts(log *models.NotificationLog) error
+	CreateNotificationAttempts(attempts []models.NotificationAttempt) error
+	GetNotificationAttempts(notificationID string) ([]models.NotificationAttempt, error)
+	CreateNotificationDeliveries(deliveries []models.NotificationDelivery) error
+	GetNotificationDeliveries(notificationID string) ([]models.NotificationDelivery, error)
+	GetNotificationDelivery(notificationID string, deviceID uint) (*models.NotificationDelivery, error)
+	UpdateNotificationDelivery(delivery *models.NotificationDelivery) error
+	CreateOutboxMessage(msg *models.OutboxMessage) error
+	Transaction(fn func(repo PushRepository) error) error
 }
 
 type pushRepository struct {
@@ -42,6 +63,16 @@ func (r *pushRepository) GetDeviceByPlayerID(playerID string) (*models.UserDevic
 	return &device, nil
 }
 
+// GetDeviceByToken retrieves a device by its raw provider token
+func (r *pushRepository) GetDeviceByToken(provider, token string) (*models.UserDevice, error) {
+	var device models.UserDevice
+	err := r.db.Where("provider = ? AND token = ?", provider, token).First(&device).Error
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
 // CreateDevice creates a new device record
 func (r *pushRepository) CreateDevice(device *models.UserDevice) error {
 	return r.db.Create(device).Error
@@ -52,6 +83,26 @@ func (r *pushRepository) UpdateDevice(device *models.UserDevice) error {
 	return r.db.Save(device).Error
 }
 
+// DeactivateDevicesByPlayerIDs marks the given devices as inactive
+func (r *pushRepository) DeactivateDevicesByPlayerIDs(playerIDs []string) error {
+	if len(playerIDs) == 0 {
+		return nil
+	}
+	return r.db.Model(&models.UserDevice{}).
+		Where("player_id IN ?", playerIDs).
+		Update("is_active", false).Error
+}
+
+// DeactivateDevicesByTokens marks the devices holding the given provider tokens as inactive
+func (r *pushRepository) DeactivateDevicesByTokens(provider string, tokens []string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return r.db.Model(&models.UserDevice{}).
+		Where("provider = ? AND token IN ?", provider, tokens).
+		Update("is_active", false).Error
+}
+
 // CreateNotificationLog creates a new notification log entry
 func (r *pushRepository) CreateNotificationLog(log *models.NotificationLog) error {
 	return r.db.Create(log).Error
@@ -62,11 +113,161 @@ func (r *pushRepository) UpdateNotificationLog(log *models.NotificationLog) erro
 	return r.db.Save(log).Error
 }
 
-// GetNotificationLog retrieves a notification log by notification ID
+// TransitionNotificationLog saves the log's new status and provider outcome only if it is still in status from.
+// It reports false when another update got there first.
+func (r *pushRepository) TransitionNotificationLog(log *models.NotificationLog, from string) (bool, error) {
+	res := r.db.Model(log).Where("status = ?", from).Updates(map[string]interface{}{
+		"status":              log.Status,
+		"error":               log.Error,
+		"provider_message_id": log.ProviderMessageID,
+		"recipients":          log.Recipients,
+		"provider":            log.Provider,
+		"updated_at":          log.UpdatedAt,
+	})
+	return res.RowsAffected > 0, res.Error
+}
+
+// CreateStatusChange appends an entry to a notification's status history
+func (r *pushRepository) CreateStatusChange(change *models.NotificationStatusChange) error {
+	return r.db.Create(change).Error
+}
+
+// GetStatusHistory retrieves a notification's status changes in the order they happened
+func (r *pushRepository) GetStatusHistory(notificationID string) ([]models.NotificationStatusChange, error) {
+	var changes []models.NotificationStatusChange
+	err := r.db.Where("notification_id = ?", notificationID).Order("id").Find(&changes).Error
+	return changes, err
+}
+
+// GetNotificationLog retrieves a notification log by our notification ID or a provider's
+// message ID. A send routed to several providers has one message ID per provider, so the
+// deliveries are searched as well as the log.
 func (r *pushRepository) GetNotificationLog(notificationID string) (*models.NotificationLog, error) {
 	var log models.NotificationLog
-	if err := r.db.Where("notification_id = ?", notificationID).First(&log).Error; err != nil {
+	byDelivery := r.db.Model(&models.NotificationDelivery{}).Select("notification_id").Where("provider_message_id = ?", notificationID)
+	if err := r.db.Where("notification_id = ? OR provider_message_id = ? OR notification_id IN (?)", notificationID, notificationID, byDelivery).First(&log).Error; err != nil {
 		return nil, err
 	}
 	return &log, nil
 }
+
+// GetNotificationsToReconcile retrieves sent notifications of kind with a device delivered
+// through provider, least recently reconciled first
+func (r *pushRepository) GetNotificationsToReconcile(kind, provider string, limit int) ([]models.NotificationLog, error) {
+	var logs []models.NotificationLog
+	err := r.db.Where("kind = ? AND status = ?", kind, "sent").
+		Where("EXISTS (?)", r.deliveredThrough(provider)).
+		Order("reconciled_at NULLS FIRST, id").
+		Limit(limit).
+		Find(&logs).Error
+	return logs, err
+}
+
+// GetStaleNotifications retrieves notifications of kind still in one of statuses that were created before the cutoff
+func (r *pushRepository) GetStaleNotifications(kind string, statuses []string, before time.Time, limit int) ([]models.NotificationLog, error) {
+	var logs []models.NotificationLog
+	err := r.db.Where("kind = ? AND status IN ? AND created_at < ?", kind, statuses, before).
+		Order("id").
+		Limit(limit).
+		Find(&logs).Error
+	return logs, err
+}
+
+// GetStaleSentNotifications retrieves sent notifications of kind with a device delivered through
+// provider that were created before the cutoff
+func (r *pushRepository) GetStaleSentNotifications(kind, provider string, before time.Time, limit int) ([]models.NotificationLog, error) {
+	var logs []models.NotificationLog
+	err := r.db.Where("kind = ? AND status = ? AND created_at < ?", kind, "sent", before).
+		Where("EXISTS (?)", r.deliveredThrough(provider)).
+		Order("id").
+		Limit(limit).
+		Find(&logs).Error
+	return logs, err
+}
+
+// deliveredThrough is a subquery matching the notification logs with a device that provider accepted
+func (r *pushRepository) deliveredThrough(provider string) *gorm.DB {
+	return r.db.Model(&models.NotificationDelivery{}).
+		Select("1").
+		Where("notification_deliveries.notification_id = notification_logs.notification_id").
+		Where("notification_deliveries.provider = ? AND notification_deliveries.provider_message_id <> ''", provider)
+}
+
+// UpdateNotificationCounts saves the provider outcome counts without touching the status
+func (r *pushRepository) UpdateNotificationCounts(log *models.NotificationLog) error {
+	return r.db.Model(log).UpdateColumns(map[string]interface{}{
+		"successful":    log.Successful,
+		"failed":        log.Failed,
+		"errored":       log.Errored,
+		"converted":     log.Converted,
+		"reconciled_at": log.ReconciledAt,
+	}).Error
+}
+
+// CreateNotificationAttempts stores the provider attempts made for a notification
+func (r *pushRepository) CreateNotificationAttempts(attempts []models.NotificationAttempt) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+	return r.db.Create(&attempts).Error
+}
+
+// GetNotificationAttempts retrieves provider attempts for a notification in the order they were made
+func (r *pushRepository) GetNotificationAttempts(notificationID string) ([]models.NotificationAttempt, error) {
+	var attempts []models.NotificationAttempt
+	err := r.db.Where("notification_id = ?", notificationID).Order("id").Find(&attempts).Error
+	return attempts, err
+}
+
+// CreateNotificationDeliveries stores the per-device outcomes of a notification. A device
+// that already has a row from an earlier attempt gets the new outcome and its attempts added up.
+func (r *pushRepository) CreateNotificationDeliveries(deliveries []models.NotificationDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	updates := clause.AssignmentColumns([]string{
+		"platform", "provider", "provider_message_id", "status", "error_code", "error", "sent_at", "updated_at",
+	})
+	updates = append(updates, clause.Assignment{
+		Column: clause.Column{Name: "attempts"},
+		Value:  gorm.Expr("notification_deliveries.attempts + excluded.attempts"),
+	})
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "notification_id"}, {Name: "device_id"}},
+		DoUpdates: updates,
+	}).Create(&deliveries).Error
+}
+
+// GetNotificationDeliveries retrieves the per-device outcomes of a notification
+func (r *pushRepository) GetNotificationDeliveries(notificationID string) ([]models.NotificationDelivery, error) {
+	var deliveries []models.NotificationDelivery
+	err := r.db.Where("notification_id = ?", notificationID).Order("id").Find(&deliveries).Error
+	return deliveries, err
+}
+
+// GetNotificationDelivery retrieves the outcome of a notification for one device
+func (r *pushRepository) GetNotificationDelivery(notificationID string, deviceID uint) (*models.NotificationDelivery, error) {
+	var delivery models.NotificationDelivery
+	err := r.db.Where("notification_id = ? AND device_id = ?", notificationID, deviceID).First(&delivery).Error
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// UpdateNotificationDelivery updates an existing delivery record
+func (r *pushRepository) UpdateNotificationDelivery(delivery *models.NotificationDelivery) error {
+	return r.db.Save(delivery).Error
+}
+
+// CreateOutboxMessage queues a message for the outbox relay
+func (r *pushRepository) CreateOutboxMessage(msg *models.OutboxMessage) error {
+	return r.db.Create(msg).Error
+}
+
+// Transaction runs fn against a repository bound to a single database transaction
+func (r *pushRepository) Transaction(fn func(repo PushRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&pushRepository{db: tx})
+	})
+}
@@ -2,7 +2,7 @@ package routes
 
 import (
 	"github.com/gofiber/fiber/v2"
-	"github.com/rabbitmq/amqp091-go"
+	"github.com/whotterre/push_microservice/internal/client"
 	"github.com/whotterre/push_microservice/internal/config"
 	"github.com/whotterre/push_microservice/internal/handlers"
 	"github.com/whotterre/push_microservice/internal/queue"
@@ -11,19 +11,28 @@ import (
 	"gorm.io/gorm"
 )
 
-func SetupRoutes(router *fiber.App, cfg *config.Config, db *gorm.DB, conn *amqp091.Connection, producer queue.PushProducer) *queue.PushConsumer {
+func SetupRoutes(router *fiber.App, cfg *config.Config, db *gorm.DB, conn *queue.ConnectionManager, producer queue.PushProducer, provider client.PushProvider) (*queue.PushConsumer, *services.Reconciler) {
 	pushRepo := repository.NewPushRepository(db)
-	pushService := services.NewPushService(pushRepo, db, conn, producer, cfg)
+	idempotencyRepo := repository.NewIdempotencyRepository(db)
+	pushService := services.NewPushService(pushRepo, idempotencyRepo, db, conn, producer, provider, cfg)
 	pushHandler := handlers.NewPushHandler(pushService)
-	consumer := queue.NewPushConsumer(conn, pushService, 10) // 10 workers
+	retryPolicy := queue.RetryPolicy{
+		MaxAttempts: cfg.RetryMaxAttempts,
+		BaseDelay:   cfg.RetryBaseDelay,
+		MaxDelay:    cfg.RetryMaxDelay,
+	}
+	consumer := queue.NewPushConsumer(conn, pushService, 10, retryPolicy) // 10 workers
+	reconciler := services.NewReconciler(pushService, cfg.ReconcileInterval, cfg.ReconcileBatchSize, cfg.NotificationExpireAfter)
 
 	// Production endpoints
 	router.Post("/push/send", pushHandler.SendPush)
 	router.Post("/push/register", pushHandler.RegisterDevice)
 	router.Post("/push/status", pushHandler.UpdateNotificationStatus)
 	router.Get("/push/status/:notification_id", pushHandler.GetNotificationStatus)
+	router.Post("/push/webhooks/onesignal", pushHandler.OneSignalWebhook)
+	router.Get("/push/vapid-public-key", pushHandler.GetVAPIDPublicKey)
 	router.Put("/push/tokens", pushHandler.DoesSomething) // /push/tokens/{user_id}
 	router.Get("/health", pushHandler.GetHealth)
 
-	return consumer
+	return consumer, reconciler
 }
@@ -0,0 +1,364 @@
+package services
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/client"
+	"github.com/whotterre/push_microservice/internal/models"
+	"github.com/whotterre/push_microservice/internal/repository"
+	"gorm.io/gorm"
+)
+
+// fakePushRepo is an in-memory PushRepository that keeps the unique indexes the
+// Postgres schema has on notification logs and deliveries
+type fakePushRepo struct {
+	mu         sync.Mutex
+	devices    []models.UserDevice
+	logs       map[string]*models.NotificationLog
+	history    []models.NotificationStatusChange
+	attempts   []models.NotificationAttempt
+	deliveries map[string]*models.NotificationDelivery // notification ID + device ID
+	outbox     []models.OutboxMessage
+	nextID     uint
+
+	failSentTransitions int // number of moves to sent that fail, as if the database were down
+}
+
+func newFakePushRepo(devices ...models.UserDevice) *fakePushRepo {
+	return &fakePushRepo{
+		devices:    devices,
+		logs:       make(map[string]*models.NotificationLog),
+		deliveries: make(map[string]*models.NotificationDelivery),
+	}
+}
+
+var _ repository.PushRepository = (*fakePushRepo)(nil)
+
+func (r *fakePushRepo) GetActiveDevicesByUserID(userID string) ([]models.UserDevice, error) {
+	var devices []models.UserDevice
+	for _, d := range r.devices {
+		if d.UserID == userID && d.IsActive {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (r *fakePushRepo) GetDeviceByPlayerID(playerID string) (*models.UserDevice, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakePushRepo) GetDeviceByToken(provider, token string) (*models.UserDevice, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakePushRepo) CreateDevice(device *models.UserDevice) error { return nil }
+
+func (r *fakePushRepo) UpdateDevice(device *models.UserDevice) error { return nil }
+
+func (r *fakePushRepo) DeactivateDevicesByPlayerIDs(playerIDs []string) error { return nil }
+
+func (r *fakePushRepo) DeactivateDevicesByTokens(provider string, tokens []string) error {
+	return nil
+}
+
+func (r *fakePushRepo) CreateNotificationLog(log *models.NotificationLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.logs[log.NotificationID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	r.nextID++
+	log.ID = r.nextID
+	log.CreatedAt = time.Now()
+	log.UpdatedAt = log.CreatedAt
+	stored := *log
+	r.logs[log.NotificationID] = &stored
+	return nil
+}
+
+func (r *fakePushRepo) UpdateNotificationLog(log *models.NotificationLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *log
+	r.logs[log.NotificationID] = &stored
+	return nil
+}
+
+func (r *fakePushRepo) TransitionNotificationLog(log *models.NotificationLog, from string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if log.Status == "sent" && r.failSentTransitions > 0 {
+		r.failSentTransitions--
+		return false, errors.New("connection refused")
+	}
+	stored, ok := r.logs[log.NotificationID]
+	if !ok || stored.Status != from {
+		return false, nil
+	}
+	updated := *log
+	r.logs[log.NotificationID] = &updated
+	return true, nil
+}
+
+func (r *fakePushRepo) CreateStatusChange(change *models.NotificationStatusChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.history = append(r.history, *change)
+	return nil
+}
+
+func (r *fakePushRepo) GetStatusHistory(notificationID string) ([]models.NotificationStatusChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var changes []models.NotificationStatusChange
+	for _, c := range r.history {
+		if c.NotificationID == notificationID {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+func (r *fakePushRepo) GetNotificationLog(notificationID string) (*models.NotificationLog, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.deliveries {
+		if d.ProviderMessageID != "" && d.ProviderMessageID == notificationID {
+			notificationID = d.NotificationID
+		}
+	}
+	for _, log := range r.logs {
+		if log.NotificationID == notificationID || (log.ProviderMessageID != "" && log.ProviderMessageID == notificationID) {
+			found := *log
+			return &found, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakePushRepo) GetNotificationsToReconcile(kind, provider string, limit int) ([]models.NotificationLog, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var logs []models.NotificationLog
+	for _, log := range r.logs {
+		if log.Kind == kind && log.Status == "sent" && r.deliveredThrough(log.NotificationID, provider) {
+			logs = append(logs, *log)
+		}
+	}
+	slices.SortFunc(logs, func(a, b models.NotificationLog) int { return cmp.Compare(a.ID, b.ID) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+func (r *fakePushRepo) GetStaleSentNotifications(kind, provider string, before time.Time, limit int) ([]models.NotificationLog, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var logs []models.NotificationLog
+	for _, log := range r.logs {
+		if log.Kind == kind && log.Status == "sent" && log.CreatedAt.Before(before) && r.deliveredThrough(log.NotificationID, provider) {
+			logs = append(logs, *log)
+		}
+	}
+	slices.SortFunc(logs, func(a, b models.NotificationLog) int { return cmp.Compare(a.ID, b.ID) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+// deliveredThrough reports whether provider accepted a device of the notification
+func (r *fakePushRepo) deliveredThrough(notificationID, provider string) bool {
+	for _, d := range r.deliveries {
+		if d.NotificationID == notificationID && d.Provider == provider && d.ProviderMessageID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *fakePushRepo) GetStaleNotifications(kind string, statuses []string, before time.Time, limit int) ([]models.NotificationLog, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var logs []models.NotificationLog
+	for _, log := range r.logs {
+		if log.Kind == kind && slices.Contains(statuses, log.Status) && log.CreatedAt.Before(before) {
+			logs = append(logs, *log)
+		}
+	}
+	slices.SortFunc(logs, func(a, b models.NotificationLog) int { return cmp.Compare(a.ID, b.ID) })
+	if len(logs) > limit {
+		logs = logs[:limit]
+	}
+	return logs, nil
+}
+
+func (r *fakePushRepo) UpdateNotificationCounts(log *models.NotificationLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stored, ok := r.logs[log.NotificationID]; ok {
+		stored.Successful, stored.Failed, stored.Errored, stored.Converted = log.Successful, log.Failed, log.Errored, log.Converted
+		stored.ReconciledAt = log.ReconciledAt
+	}
+	return nil
+}
+
+func (r *fakePushRepo) CreateNotificationAttempts(attempts []models.NotificationAttempt) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts = append(r.attempts, attempts...)
+	return nil
+}
+
+func (r *fakePushRepo) GetNotificationAttempts(notificationID string) ([]models.NotificationAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var attempts []models.NotificationAttempt
+	for _, a := range r.attempts {
+		if a.NotificationID == notificationID {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, nil
+}
+
+func (r *fakePushRepo) CreateNotificationDeliveries(deliveries []models.NotificationDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range deliveries {
+		key := deliveryKey(d.NotificationID, d.DeviceID)
+		if existing, ok := r.deliveries[key]; ok {
+			d.ID = existing.ID
+			d.Attempts += existing.Attempts
+		}
+		stored := d
+		r.deliveries[key] = &stored
+	}
+	return nil
+}
+
+func (r *fakePushRepo) GetNotificationDeliveries(notificationID string) ([]models.NotificationDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deliveries []models.NotificationDelivery
+	for _, d := range r.deliveries {
+		if d.NotificationID == notificationID {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (r *fakePushRepo) GetNotificationDelivery(notificationID string, deviceID uint) (*models.NotificationDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.deliveries[deliveryKey(notificationID, deviceID)]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	found := *d
+	return &found, nil
+}
+
+func (r *fakePushRepo) UpdateNotificationDelivery(delivery *models.NotificationDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored := *delivery
+	r.deliveries[deliveryKey(delivery.NotificationID, delivery.DeviceID)] = &stored
+	return nil
+}
+
+func (r *fakePushRepo) CreateOutboxMessage(msg *models.OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outbox = append(r.outbox, *msg)
+	return nil
+}
+
+func (r *fakePushRepo) Transaction(fn func(repo repository.PushRepository) error) error {
+	return fn(r)
+}
+
+func deliveryKey(notificationID string, deviceID uint) string {
+	return fmt.Sprintf("%s/%d", notificationID, deviceID)
+}
+
+// fakeIdempotencyRepo is an in-memory IdempotencyRepository
+type fakeIdempotencyRepo struct {
+	mu     sync.Mutex
+	claims map[string]*models.IdempotencyKey
+}
+
+func newFakeIdempotencyRepo() *fakeIdempotencyRepo {
+	return &fakeIdempotencyRepo{claims: make(map[string]*models.IdempotencyKey)}
+}
+
+func (r *fakeIdempotencyRepo) Claim(key string, lease time.Duration) (*models.IdempotencyKey, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.claims[key]; ok {
+		found := *existing
+		return &found, false, nil
+	}
+	claim := &models.IdempotencyKey{Key: key, Status: models.IdempotencyProcessing, ClaimedAt: time.Now()}
+	r.claims[key] = claim
+	found := *claim
+	return &found, true, nil
+}
+
+func (r *fakeIdempotencyRepo) Complete(key string, response string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.claims[key] = &models.IdempotencyKey{Key: key, Status: models.IdempotencyCompleted, Response: &response, CompletedAt: &now}
+	return nil
+}
+
+func (r *fakeIdempotencyRepo) Release(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if claim, ok := r.claims[key]; ok && claim.Status == models.IdempotencyProcessing {
+		delete(r.claims, key)
+	}
+	return nil
+}
+
+// fakeProvider replays one scripted outcome per SendToDevices call
+type fakeProvider struct {
+	outcomes []fakeOutcome
+	calls    int
+	messages []*client.PushMessage
+}
+
+type fakeOutcome struct {
+	res *client.SendResult
+	err error
+}
+
+func (p *fakeProvider) Name() string { return client.ProviderOneSignal }
+
+func (p *fakeProvider) Capabilities() client.ProviderCapabilities {
+	return client.ProviderCapabilities{Platforms: []string{"web", "ios", "android"}}
+}
+
+func (p *fakeProvider) SendToDevices(devices []client.Device, msg *client.PushMessage) (*client.SendResult, error) {
+	outcome := p.outcomes[p.calls]
+	p.calls++
+	p.messages = append(p.messages, msg)
+	return outcome.res, outcome.err
+}
+
+func (p *fakeProvider) SendToSegment(segment string, msg *client.PushMessage) (*client.SendResult, error) {
+	return nil, nil
+}
+
+func (p *fakeProvider) ListDevices(limit, offset int) (*client.PlayersResponse, error) {
+	return nil, nil
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/dto"
+	"github.com/whotterre/push_microservice/internal/models"
+)
+
+// withIdempotency runs send at most once per notification ID. The ID is claimed
+// first; a completed claim returns the stored response without calling send, and a
+// claim held by another attempt is in progress, to be retried. Requests without an ID always send.
+// The claim is only released for a retryable failure that reached no provider, which
+// leaves the notification queued for the retry to pick up.
+func (s *pushService) withIdempotency(notificationID string, send func() (*dto.PushResponse, error)) (*dto.PushResponse, error) {
+	if notificationID == "" || s.idempotencyRepo == nil {
+		return send()
+	}
+
+	claim, claimed, err := s.idempotencyRepo.Claim(notificationID, s.cfg.IdempotencyLease)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim notification %s: %w", notificationID, err)
+	}
+	if !claimed {
+		if claim.Status != models.IdempotencyCompleted || claim.Response == nil {
+			return nil, apperrors.InProgress("notification %s is already being processed", notificationID)
+		}
+		var original dto.PushResponse
+		if err := json.Unmarshal([]byte(*claim.Response), &original); err != nil {
+			return nil, fmt.Errorf("failed to decode stored response for notification %s: %w", notificationID, err)
+		}
+		recovered, err := s.recoverSent(notificationID, &original)
+		if err != nil {
+			return nil, err
+		}
+		if recovered {
+			original.Success = true
+			original.Message = "Notification sent successfully"
+		}
+		log.Printf("Notification %s was already sent, returning the original result", notificationID)
+		return &original, nil
+	}
+
+	response, err := send()
+
+	// Anything that reached a provider, or failed for good, is final; otherwise let a retry send it
+	reached := response != nil && (response.Success || response.ProviderMessageID != "" || response.Recipients > 0)
+	if reached || (response != nil && !apperrors.IsRetryable(err)) {
+		body, marshalErr := json.Marshal(response)
+		if marshalErr == nil {
+			marshalErr = s.idempotencyRepo.Complete(notificationID, string(body))
+		}
+		if marshalErr != nil {
+			log.Printf("Warning: Failed to complete idempotency claim for %s: %v", notificationID, marshalErr)
+		}
+	} else if releaseErr := s.idempotencyRepo.Release(notificationID); releaseErr != nil {
+		log.Printf("Warning: Failed to release idempotency claim for %s: %v", notificationID, releaseErr)
+	}
+
+	return response, err
+}
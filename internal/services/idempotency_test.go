@@ -0,0 +1,122 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/client"
+	"github.com/whotterre/push_microservice/internal/config"
+	"github.com/whotterre/push_microservice/internal/dto"
+	"github.com/whotterre/push_microservice/internal/models"
+)
+
+func newTestPushService(repo *fakePushRepo, claims *fakeIdempotencyRepo, provider client.PushProvider) *pushService {
+	return &pushService{
+		pushRepo:        repo,
+		idempotencyRepo: claims,
+		provider:        provider,
+		cfg:             &config.Config{DefaultLocale: "en"},
+	}
+}
+
+func TestSendPushNotificationRetryAfterFailureSucceeds(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "android", IsActive: true})
+	claims := newFakeIdempotencyRepo()
+	provider := &fakeProvider{outcomes: []fakeOutcome{
+		{
+			res: &client.SendResult{Provider: client.ProviderOneSignal, Results: []client.DeviceResult{
+				{Provider: client.ProviderOneSignal, Token: playerID, Error: "timeout"},
+			}},
+			err: apperrors.Transient(errors.New("onesignal: timeout")),
+		},
+		{
+			res: &client.SendResult{Provider: client.ProviderOneSignal, ID: "os-1", Recipients: 1, Results: []client.DeviceResult{
+				{Provider: client.ProviderOneSignal, Token: playerID, MessageID: "os-1"},
+			}},
+		},
+	}}
+	s := newTestPushService(repo, claims, provider)
+	req := func() *dto.PushRequest {
+		return &dto.PushRequest{NotificationID: "notif-1", UserID: "user-1", Title: "Hi", Message: "Hello"}
+	}
+
+	res, err := s.SendPushNotification(req())
+	if err == nil || res.Success {
+		t.Fatalf("first send: got success %v, err %v; want a failure", res.Success, err)
+	}
+	notificationLog, _ := repo.GetNotificationLog("notif-1")
+	if notificationLog.Status != string(dto.NotificationStatusQueued) {
+		t.Fatalf("after a retryable failure the log is %s, want queued", notificationLog.Status)
+	}
+	if _, held := claims.claims["notif-1"]; held {
+		t.Fatal("claim was not released after a retryable failure")
+	}
+
+	res, err = s.SendPushNotification(req())
+	if err != nil || !res.Success {
+		t.Fatalf("retry: got success %v, err %v; want success", res.Success, err)
+	}
+	if res.ProviderMessageID != "os-1" {
+		t.Errorf("retry response provider message ID = %q, want os-1", res.ProviderMessageID)
+	}
+
+	notificationLog, _ = repo.GetNotificationLog("notif-1")
+	if notificationLog.Status != string(dto.NotificationStatusSent) || notificationLog.ProviderMessageID != "os-1" {
+		t.Errorf("log = %s/%q, want sent/os-1", notificationLog.Status, notificationLog.ProviderMessageID)
+	}
+	if notificationLog.Error != nil {
+		t.Errorf("log error = %q, want the first attempt's error cleared", *notificationLog.Error)
+	}
+	if claim := claims.claims["notif-1"]; claim == nil || claim.Status != models.IdempotencyCompleted {
+		t.Error("claim was not completed after the successful retry")
+	}
+
+	deliveries, _ := repo.GetNotificationDeliveries("notif-1")
+	if len(deliveries) != 1 || deliveries[0].Status != string(dto.NotificationStatusSent) || deliveries[0].Attempts != 2 {
+		t.Errorf("deliveries = %+v, want one sent delivery with 2 attempts", deliveries)
+	}
+
+	var path []string
+	for _, change := range repo.history {
+		path = append(path, change.ToStatus)
+	}
+	want := []string{"queued", "sending", "queued", "sending", "sent"}
+	if len(path) != len(want) {
+		t.Fatalf("status history = %v, want %v", path, want)
+	}
+	for i := range want {
+		if path[i] != want[i] {
+			t.Fatalf("status history = %v, want %v", path, want)
+		}
+	}
+
+	// A repeat after success returns the stored response without sending again
+	res, err = s.SendPushNotification(req())
+	if err != nil || !res.Success || provider.calls != 2 {
+		t.Errorf("repeat: success %v, err %v, provider calls %d; want the stored success and 2 calls", res.Success, err, provider.calls)
+	}
+}
+
+func TestSendPushNotificationFinalFailureKeepsClaim(t *testing.T) {
+	repo := newFakePushRepo()
+	claims := newFakeIdempotencyRepo()
+	s := newTestPushService(repo, claims, &fakeProvider{})
+
+	req := &dto.PushRequest{NotificationID: "notif-2", UserID: "user-without-devices", Title: "Hi", Message: "Hello"}
+	res, err := s.SendPushNotification(req)
+	if err != nil || res.Success {
+		t.Fatalf("got success %v, err %v; want a failure response", res.Success, err)
+	}
+	notificationLog, _ := repo.GetNotificationLog("notif-2")
+	if notificationLog.Status != string(dto.NotificationStatusFailed) {
+		t.Errorf("log is %s, want failed", notificationLog.Status)
+	}
+
+	// The retry gets the original failure rather than a duplicate-key error
+	res, err = s.SendPushNotification(req)
+	if err != nil || res.Message != "No active devices found for user" {
+		t.Errorf("retry: message %q, err %v; want the stored failure", res.Message, err)
+	}
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/whotterre/push_microservice/internal/client"
+)
+
+// localeFallbacks maps a lowercased locale to the locales tried after it, on top of
+// the automatic fallback from a regional locale to its language (pt-BR -> pt)
+type localeFallbacks map[string][]string
+
+// parseLocaleFallbacks parses a LOCALE_FALLBACKS spec such as "pt-BR=pt-PT;es-MX=es-ES,es"
+func parseLocaleFallbacks(spec string) (localeFallbacks, error) {
+	fallbacks := make(localeFallbacks)
+	for _, rule := range strings.Split(spec, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		locale, chain, ok := strings.Cut(rule, "=")
+		locale = normalizeLocale(locale)
+		if !ok || locale == "" {
+			return nil, fmt.Errorf("invalid locale fallback %q: expected locale=locale[,locale...]", rule)
+		}
+		for _, next := range strings.Split(chain, ",") {
+			if next = normalizeLocale(next); next != "" {
+				fallbacks[locale] = append(fallbacks[locale], next)
+			}
+		}
+		if len(fallbacks[locale]) == 0 {
+			return nil, fmt.Errorf("invalid locale fallback %q: no fallbacks", rule)
+		}
+	}
+	return fallbacks, nil
+}
+
+// chain lists the locales to try for a device in locale, e.g. pt-br, pt, en,
+// ending with the default locale and its language
+func (f localeFallbacks) chain(locale, defaultLocale string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+	var add func(locale string)
+	add = func(locale string) {
+		for ; locale != ""; locale = parentLocale(locale) {
+			if seen[locale] {
+				continue
+			}
+			seen[locale] = true
+			chain = append(chain, locale)
+			for _, next := range f[locale] {
+				add(next)
+			}
+		}
+	}
+	add(normalizeLocale(locale))
+	add(normalizeLocale(defaultLocale))
+	return chain
+}
+
+// resolveLocale returns the first key of available in chain, matching case-insensitively
+func resolveLocale(available []string, chain []string) (string, bool) {
+	keys := make(map[string]string, len(available))
+	for _, key := range available {
+		keys[normalizeLocale(key)] = key
+	}
+	for _, locale := range chain {
+		if key, ok := keys[locale]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// localize settles the message's default content and points every device at the
+// language it should receive. The request's plain title and message are the default;
+// without them the default locale's content, or else the first language, is used.
+func (s *pushService) localize(msg *client.PushMessage, targets []client.Device) {
+	available := localizedLanguages(msg)
+	if len(available) == 0 {
+		return
+	}
+
+	if msg.Message == "" {
+		key, ok := resolveLocale(available, s.localeFallbacks.chain("", s.cfg.DefaultLocale))
+		if !ok {
+			key = available[0]
+		}
+		localized := msg.ForLocale(key)
+		msg.Title, msg.Message = localized.Title, localized.Message
+	}
+
+	for i := range targets {
+		key, _ := resolveLocale(available, s.localeFallbacks.chain(targets[i].Locale, s.cfg.DefaultLocale))
+		targets[i].Locale = key
+	}
+}
+
+// localizedLanguages returns the sorted language tags a message has content in
+func localizedLanguages(msg *client.PushMessage) []string {
+	seen := make(map[string]bool)
+	var languages []string
+	for _, m := range []map[string]string{msg.Messages, msg.Titles} {
+		for tag := range m {
+			if !seen[tag] {
+				seen[tag] = true
+				languages = append(languages, tag)
+			}
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// normalizeLocale lowercases a locale and uses - as its separator: pt_BR becomes pt-br
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// parentLocale drops the last subtag: pt-br becomes pt, pt becomes empty
+func parentLocale(locale string) string {
+	if i := strings.LastIndex(locale, "-"); i > 0 {
+		return locale[:i]
+	}
+	return ""
+}
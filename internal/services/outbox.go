@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/models"
+	"github.com/whotterre/push_microservice/internal/queue"
+	"github.com/whotterre/push_microservice/internal/repository"
+)
+
+// OutboxRelay publishes outbox rows to RabbitMQ with at-least-once semantics:
+// a row is only marked dispatched after the broker confirmed it, so a crash in
+// between publishes it again. Consumers dedupe on the AMQP message ID.
+type OutboxRelay struct {
+	outboxRepo repository.OutboxRepository
+	producer   queue.PushProducer
+	interval   time.Duration
+	batchSize  int
+}
+
+func NewOutboxRelay(outboxRepo repository.OutboxRepository, producer queue.PushProducer, interval time.Duration, batchSize int) *OutboxRelay {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return &OutboxRelay{
+		outboxRepo: outboxRepo,
+		producer:   producer,
+		interval:   interval,
+		batchSize:  batchSize,
+	}
+}
+
+// Run relays pending rows every interval until ctx is cancelled. A full batch is
+// followed straight away by the next one so a backlog drains without waiting.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down outbox relay...")
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			dispatched, err := r.outboxRepo.DispatchPending(r.batchSize, r.publish)
+			if err != nil {
+				log.Printf("Outbox relay: %v", err)
+				break
+			}
+			if dispatched < r.batchSize || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+func (r *OutboxRelay) publish(msg *models.OutboxMessage) error {
+	err := r.producer.PublishEnvelope(&queue.Envelope{
+		Exchange:      msg.Exchange,
+		RoutingKey:    msg.RoutingKey,
+		MessageID:     msg.MessageID,
+		CorrelationID: msg.CorrelationID,
+		Body:          []byte(msg.Payload),
+	})
+	if err != nil {
+		log.Printf("[%s] Failed to relay outbox message %s to %s/%s: %v",
+			msg.CorrelationID, msg.MessageID, msg.Exchange, msg.RoutingKey, err)
+	}
+	return err
+}
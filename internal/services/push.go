@@ -2,12 +2,14 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/rabbitmq/amqp091-go"
+	"github.com/whotterre/push_microservice/internal/apperrors"
 	"github.com/whotterre/push_microservice/internal/client"
 	"github.com/whotterre/push_microservice/internal/config"
 	"github.com/whotterre/push_microservice/internal/dto"
@@ -17,266 +19,822 @@ import (
 	"gorm.io/gorm"
 )
 
+// recordSentAttempts bounds how often recording a delivered send is tried, starting
+// recordSentBackoff apart and doubling
+const (
+	recordSentAttempts = 3
+	recordSentBackoff  = 100 * time.Millisecond
+)
+
+// Sources of a status change, recorded in the status history
+const (
+	StatusSourceSend       = "send"       // the push service sending the notification
+	StatusSourceAPI        = "api"        // POST /push/status
+	StatusSourceWebhook    = "webhook"    // provider delivery webhooks
+	StatusSourceReconciler = "reconciler" // outcomes polled from the provider, and expiry
+)
+
 type PushService interface {
 	GetHealth() (*dto.GetHealthResponse, error)
-	ProcessSendMessage(message []byte) error
+	ProcessSendMessage(message []byte, correlationID, notificationID string, deadline time.Time) error
 	ProcessTokenMessage(message []byte) error
 	SendPushNotification(req *dto.PushRequest) (*dto.PushResponse, error)
-	SendToPlayers(playerIDs []string, title, message string, data map[string]interface{}) (*client.OneSignalResponse, error)
-	SendToSegment(segment, title, message string, data map[string]interface{}) (*client.OneSignalResponse, error)
+	SendToPlayers(playerIDs []string, title, message string, data map[string]interface{}) (*client.SendResult, error)
+	SendToSegment(segment, title, message string, data map[string]interface{}) (*client.SendResult, error)
 	GetPlayers(limit, offset int) (*client.PlayersResponse, error)
 	UpdateNotificationStatus(req *dto.NotificationStatusUpdate) error
 	GetNotificationStatus(notificationID string) (*dto.NotificationStatusResponse, error)
+	HandleOneSignalWebhook(body []byte, signature, secret string) error
+	ReconcileNotifications(limit int) (int, error)
+	ExpireStaleNotifications(olderThan time.Duration, limit int) (int, error)
+	GetVAPIDPublicKey() (*dto.VAPIDPublicKeyResponse, error)
 }
 
 type pushService struct {
 	pushRepo        repository.PushRepository
-	bunnyConn       *amqp091.Connection
+	idempotencyRepo repository.IdempotencyRepository
+	bunnyConn       *queue.ConnectionManager
 	db              *gorm.DB
 	producer        queue.PushProducer
-	oneSignalClient *client.OneSignalClient
+	provider        client.PushProvider
+	templates       *TemplateRenderer
+	localeFallbacks localeFallbacks
+	cfg             *config.Config
 }
 
-func NewPushService(pushRepo repository.PushRepository, db *gorm.DB, bunnyConn *amqp091.Connection, producer queue.PushProducer, cfg *config.Config) PushService {
+func NewPushService(pushRepo repository.PushRepository, idempotencyRepo repository.IdempotencyRepository, db *gorm.DB, bunnyConn *queue.ConnectionManager, producer queue.PushProducer, provider client.PushProvider, cfg *config.Config) PushService {
+	fallbacks, err := parseLocaleFallbacks(cfg.LocaleFallbacks)
+	if err != nil {
+		log.Printf("Invalid LOCALE_FALLBACKS, only falling back to the language and %s: %v", cfg.DefaultLocale, err)
+	}
 	return &pushService{
 		pushRepo:        pushRepo,
+		idempotencyRepo: idempotencyRepo,
 		bunnyConn:       bunnyConn,
 		db:              db,
 		producer:        producer,
-		oneSignalClient: client.NewOneSignalClient(cfg),
+		provider:        provider,
+		templates:       NewTemplateRenderer(client.NewTemplateClient(cfg), cfg.TemplateVersionCacheTTL),
+		localeFallbacks: fallbacks,
+		cfg:             cfg,
 	}
 }
 
-func (s *pushService) ProcessSendMessage(message []byte) error {
+func (s *pushService) ProcessSendMessage(message []byte, correlationID, notificationID string, deadline time.Time) error {
 	var pushReq dto.PushRequest
 	if err := json.Unmarshal(message, &pushReq); err != nil {
 		log.Printf("Failed to unmarshal push request: %v", err)
-		return fmt.Errorf("invalid message format: %w", err)
+		return apperrors.Validation("invalid message format: %w", err)
+	}
+	if correlationID != "" {
+		pushReq.CorrelationID = correlationID
+	}
+	// Set before the claim, or every retry of a request without an ID would send again
+	if pushReq.NotificationID == "" {
+		pushReq.NotificationID = notificationID
 	}
 
 	log.Printf("Processing push notification for user: %s", pushReq.UserID)
 
 	// Validate required fields
-	if pushReq.Title == "" {
-		pushReq.Title = "Notification" // Default title
-		log.Printf("Warning: No title provided, using default")
+	if err := validateDeliveryOptions(&pushReq); err != nil {
+		return err
 	}
-	if pushReq.Message == "" {
-		log.Printf("Error: Message is required but was empty")
-		return fmt.Errorf("invalid message format: message field is required")
+	if pushReq.Silent {
+		if err := validateSilentPush(&pushReq); err != nil {
+			return err
+		}
+	} else {
+		if pushReq.Title == "" {
+			pushReq.Title = "Notification" // Default title
+			log.Printf("Warning: No title provided, using default")
+		}
+		if pushReq.Message == "" && len(pushReq.Messages) == 0 && pushReq.TemplateID == "" {
+			log.Printf("Error: Message is required but was empty")
+			return apperrors.Validation("invalid message format: message, messages or template_id is required")
+		}
+		if err := validateRichContent(&pushReq); err != nil {
+			return err
+		}
 	}
 
-	devices, err := s.pushRepo.GetActiveDevicesByUserID(pushReq.UserID)
-	if err != nil {
-		log.Printf("Failed to fetch devices for user %s: %v", pushReq.UserID, err)
-		return fmt.Errorf("failed to fetch user devices: %w", err)
-	}
+	_, err := s.withIdempotency(pushReq.NotificationID, func() (*dto.PushResponse, error) {
+		return s.deliverQueuedMessage(&pushReq, deadline)
+	})
+	return err
+}
 
-	if len(devices) == 0 {
-		log.Printf("No active devices found for user: %s", pushReq.UserID)
-		return fmt.Errorf("no active devices for user: %s", pushReq.UserID)
+// deliverQueuedMessage sends a push taken off push.send.queue and records it. A retry
+// is sent with what is left of the ttl until deadline, or expired once none is left.
+func (s *pushService) deliverQueuedMessage(pushReq *dto.PushRequest, deadline time.Time) (*dto.PushResponse, error) {
+	ensureNotificationID(pushReq)
+	if err := s.openNotification(pushReq); err != nil {
+		return nil, err
 	}
 
-	playerIDs := make([]string, 0, len(devices))
-	for _, device := range devices {
-		playerIDs = append(playerIDs, device.PlayerID)
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		// Providers take the ttl in whole seconds and read 0 as now-or-never, so
+		// less than a second left is as good as none
+		if remaining < time.Second {
+			log.Printf("Notification %s passed its ttl before it could be sent", pushReq.NotificationID)
+			errMsg := "ttl elapsed before the notification could be sent"
+			if err := s.transitionStatus(pushReq.NotificationID, dto.NotificationStatusExpired, &errMsg, StatusSourceSend); err != nil {
+				// Not acked, or the log would be left queued or sending for good
+				return nil, fmt.Errorf("failed to record notification %s as expired: %w", pushReq.NotificationID, err)
+			}
+			return &dto.PushResponse{
+				Success:        false,
+				NotificationID: pushReq.NotificationID,
+				Message:        "Notification expired before it could be sent",
+			}, nil
+		}
+		ttl := int(remaining / time.Second)
+		pushReq.TTL = &ttl
 	}
 
-	log.Printf("Sending notification to %d device(s) for user %s. Title: '%s', Message: '%s'",
-		len(playerIDs), pushReq.UserID, pushReq.Title, pushReq.Message)
+	return s.deliver(pushReq)
+}
 
-	res, err := s.oneSignalClient.SendToUsers(playerIDs, pushReq.Title, pushReq.Message, pushReq.Data)
-	if err != nil {
-		log.Printf("Failed to send notification: %v", err)
-		return fmt.Errorf("failed to send notification: %w", err)
+func (s *pushService) ProcessTokenMessage(message []byte) error {
+	var tokenUpdate dto.TokenUpdate
+	if err := json.Unmarshal(message, &tokenUpdate); err != nil {
+		log.Printf("Failed to unmarshal token update: %v", err)
+		return apperrors.Validation("invalid message format: %w", err)
 	}
 
-	log.Printf("Notification sent successfully. ID: %s, Recipients: %d", res.ID, res.Recipients)
+	log.Printf("Processing token update for user: %s, platform: %s", tokenUpdate.UserID, tokenUpdate.Platform)
 
-	if len(res.GetErrors()) > 0 {
-		log.Printf("Notification warnings: %v", res.GetErrors())
+	if sub := tokenUpdate.Subscription; sub != nil {
+		if sub.Endpoint == "" || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+			return apperrors.Validation("invalid message format: subscription requires endpoint, p256dh and auth")
+		}
 	}
 
-	// Create notification log
-	notificationLog := &models.NotificationLog{
-		NotificationID: res.ID,
-		UserID:         pushReq.UserID,
-		Status:         string(dto.NotificationStatusPending),
-		Recipients:     res.Recipients,
+	provider, token := resolveDeviceToken(&tokenUpdate)
+	nativeToken := token != ""
+	var playerID *string
+	if tokenUpdate.OneSignalPlayerID != "" {
+		playerID = &tokenUpdate.OneSignalPlayerID
 	}
-	if err := s.pushRepo.CreateNotificationLog(notificationLog); err != nil {
-		log.Printf("Warning: Failed to create notification log: %v", err)
-		// Don't fail the request if logging fails
+	if !nativeToken {
+		if playerID == nil {
+			return apperrors.Validation("invalid message format: device_token, subscription or onesignal_player_id is required")
+		}
+		// OneSignal-only device, the player ID is its token
+		provider, token = client.ProviderOneSignal, *playerID
 	}
 
-	return nil
-}
+	// Check if device already exists
+	existingDevice, err := s.findDevice(provider, token, playerID)
 
-func (s *pushService) ProcessTokenMessage(message []byte) error {
-	var tokenUpdate dto.TokenUpdate
-	if err := json.Unmarshal(message, &tokenUpdate); err != nil {
-		log.Printf("Failed to unmarshal token update: %v", err)
-		return fmt.Errorf("invalid message format: %w", err)
+	device := existingDevice
+	if err != nil || device == nil {
+		device = &models.UserDevice{}
 	}
 
-	log.Printf("Processing token update for user: %s, platform: %s", tokenUpdate.UserID, tokenUpdate.Platform)
-
-	// Check if device already exists
-	existingDevice, err := s.pushRepo.GetDeviceByPlayerID(tokenUpdate.OneSignalPlayerID)
+	now := time.Now()
+	device.UserID = tokenUpdate.UserID
+	device.Platform = tokenUpdate.Platform
+	device.IsActive = true
+	device.LastSeenAt = &now
+	// A OneSignal-only update must not clobber a native token registered earlier
+	if nativeToken || device.ID == 0 || device.Provider == client.ProviderOneSignal {
+		device.Provider = provider
+		device.Token = token
+	}
+	if playerID != nil {
+		device.PlayerID = playerID
+	}
+	applyWebPushSubscription(device, tokenUpdate.Subscription)
+	if tokenUpdate.AppVersion != "" {
+		device.AppVersion = tokenUpdate.AppVersion
+	}
+	if tokenUpdate.Locale != "" {
+		device.Locale = tokenUpdate.Locale
+	}
+	if tokenUpdate.Timezone != "" {
+		device.Timezone = tokenUpdate.Timezone
+	}
 
-	if err == nil && existingDevice != nil {
+	if device.ID != 0 {
 		// Device exists, update it
-		existingDevice.UserID = tokenUpdate.UserID
-		existingDevice.Platform = tokenUpdate.Platform
-		existingDevice.IsActive = true
-		if err := s.pushRepo.UpdateDevice(existingDevice); err != nil {
+		if err := s.pushRepo.UpdateDevice(device); err != nil {
 			log.Printf("Failed to update device: %v", err)
 			return fmt.Errorf("failed to update device: %w", err)
 		}
-		log.Printf("Updated existing device for user: %s", tokenUpdate.UserID)
+		log.Printf("Updated existing %s device for user: %s", device.Provider, tokenUpdate.UserID)
 	} else {
 		// Create new device
-		newDevice := &models.UserDevice{
-			UserID:   tokenUpdate.UserID,
-			PlayerID: tokenUpdate.OneSignalPlayerID,
-			Platform: tokenUpdate.Platform,
-			IsActive: true,
-		}
-		if err := s.pushRepo.CreateDevice(newDevice); err != nil {
+		if err := s.pushRepo.CreateDevice(device); err != nil {
 			log.Printf("Failed to create device: %v", err)
 			return fmt.Errorf("failed to create device: %w", err)
 		}
-		log.Printf("Created new device for user: %s", tokenUpdate.UserID)
+		log.Printf("Created new %s device for user: %s", provider, tokenUpdate.UserID)
 	}
 
 	return nil
 }
 
+// findDevice looks a device up by its native token first, then by OneSignal player ID
+func (s *pushService) findDevice(provider, token string, playerID *string) (*models.UserDevice, error) {
+	device, err := s.pushRepo.GetDeviceByToken(provider, token)
+	if err == nil || playerID == nil {
+		return device, err
+	}
+	return s.pushRepo.GetDeviceByPlayerID(*playerID)
+}
+
+// resolveDeviceToken works out which provider a registration's raw token belongs to.
+// Web Push subscriptions are keyed by their endpoint; bare device tokens default to
+// APNs on iOS and FCM elsewhere unless the caller names the provider.
+func resolveDeviceToken(update *dto.TokenUpdate) (string, string) {
+	if update.Subscription != nil {
+		return client.ProviderWebPush, update.Subscription.Endpoint
+	}
+	if update.DeviceToken == "" {
+		return "", ""
+	}
+	if update.Provider != "" {
+		return strings.ToLower(update.Provider), update.DeviceToken
+	}
+	if strings.EqualFold(update.Platform, "ios") {
+		return client.ProviderAPNs, update.DeviceToken
+	}
+	return client.ProviderFCM, update.DeviceToken
+}
+
+// applyWebPushSubscription stores a browser PushSubscription on the device
+func applyWebPushSubscription(device *models.UserDevice, sub *dto.WebPushSubscription) {
+	if sub == nil {
+		return
+	}
+	device.WebPushEndpoint = sub.Endpoint
+	device.WebPushP256dh = sub.Keys.P256dh
+	device.WebPushAuth = sub.Keys.Auth
+}
+
+// SendPushNotification sends a push synchronously. A repeated request with the same
+// notification_id returns the original response instead of sending again.
 func (s *pushService) SendPushNotification(req *dto.PushRequest) (*dto.PushResponse, error) {
+	return s.withIdempotency(req.NotificationID, func() (*dto.PushResponse, error) {
+		return s.sendPushNotification(req)
+	})
+}
+
+func (s *pushService) sendPushNotification(req *dto.PushRequest) (*dto.PushResponse, error) {
 	if req.UserID == "" {
-		return nil, fmt.Errorf("user_id is required")
+		return nil, apperrors.Validation("user_id is required")
+	}
+	if err := validateDeliveryOptions(req); err != nil {
+		return nil, err
 	}
 
-	if req.Title == "" || req.Message == "" {
-		return nil, fmt.Errorf("title and message are required")
+	if req.Silent {
+		if err := validateSilentPush(req); err != nil {
+			return nil, err
+		}
+	} else {
+		if (req.Title == "" || req.Message == "") && len(req.Messages) == 0 && req.TemplateID == "" {
+			return nil, apperrors.Validation("title and message, messages or template_id are required")
+		}
+		if err := validateRichContent(req); err != nil {
+			return nil, err
+		}
+	}
+	ensureNotificationID(req)
+	if err := s.openNotification(req); err != nil {
+		return nil, err
 	}
 
-	// Get active devices for the user
+	res, err := s.deliver(req)
+	if errors.Is(err, apperrors.ErrNotFound) {
+		// A user nobody can reach is an outcome of the API call, not an error
+		return res, nil
+	}
+	return res, err
+}
+
+// deliver sends an opened notification to the user's active devices and records the
+// outcome on its log, attempts and deliveries. Both the API and the queue send through it.
+func (s *pushService) deliver(req *dto.PushRequest) (*dto.PushResponse, error) {
 	devices, err := s.pushRepo.GetActiveDevicesByUserID(req.UserID)
 	if err != nil {
 		log.Printf("Failed to fetch devices for user %s: %v", req.UserID, err)
-		return &dto.PushResponse{
-			Success: false,
-			Message: "Failed to fetch user devices",
-			Errors:  []string{err.Error()},
-		}, err
+		err = fmt.Errorf("failed to fetch user devices: %w", err)
+		return failureResponse(req.NotificationID, "Failed to fetch user devices", err), err
 	}
 
 	if len(devices) == 0 {
 		log.Printf("No active devices found for user: %s", req.UserID)
+		err := apperrors.NotFound("no active devices for user: %s", req.UserID)
+		s.recordFailure(req.NotificationID, err)
+		return failureResponse(req.NotificationID, "No active devices found for user", nil), err
+	}
+
+	if err := s.applyTemplate(req, devices); err != nil {
+		log.Printf("Failed to render template %s: %v", req.TemplateID, err)
+		s.recordFailure(req.NotificationID, err)
+		return failureResponse(req.NotificationID, "Failed to render template", err), err
+	}
+
+	targets := toProviderDevices(devices)
+
+	log.Printf("Sending notification to %d device(s) for user %s", len(targets), req.UserID)
+
+	if err := s.transitionStatus(req.NotificationID, dto.NotificationStatusSending, nil, StatusSourceSend); err != nil {
+		return nil, err
+	}
+	msg := newPushMessage(req)
+	s.localize(msg, targets)
+	res, err := s.provider.SendToDevices(targets, msg)
+	s.deactivateUnregisteredDevices(res)
+	if errors.Is(err, client.ErrNoRoute) {
+		log.Printf("No configured provider can reach the devices of user: %s", req.UserID)
+		err := apperrors.NotFound("no active devices for user: %s reachable by configured providers", req.UserID)
+		s.recordFailure(req.NotificationID, err)
+		s.recordDeliveries(req.NotificationID, devices, res)
+		return failureResponse(req.NotificationID, "No active devices found for user reachable by configured providers", nil), err
+	}
+	if err != nil {
+		log.Printf("Failed to send notification: %v", err)
+		s.recordFailure(req.NotificationID, err)
+		s.recordAttempts(req.NotificationID, res)
+		s.recordDeliveries(req.NotificationID, devices, res)
+		return failureResponse(req.NotificationID, "Failed to send notification", err), fmt.Errorf("failed to send notification: %w", err)
+	}
+
+	log.Printf("Notification sent successfully via %s. ID: %s, Recipients: %d", res.Provider, res.ID, res.Recipients)
+
+	if len(res.Errors) > 0 {
+		log.Printf("Notification warnings: %v", res.Errors)
+	}
+
+	response := &dto.PushResponse{
+		Success:           true,
+		NotificationID:    req.NotificationID,
+		ProviderMessageID: res.ID,
+		Provider:          res.Provider,
+		Recipients:        res.Recipients,
+		Errors:            res.Errors,
+		Message:           "Notification sent successfully",
+	}
+	if err := s.recordSent(req.NotificationID, res); err != nil {
+		// Surfaced rather than swallowed. The push went out, so the idempotency
+		// claim is still completed with the outcome: the redelivery this error
+		// causes does not send again but records the outcome from the claim.
+		log.Printf("Failed to record notification %s: %v", req.NotificationID, err)
+		response.Success = false
+		response.Message = "Notification sent but could not be recorded"
+		response.Errors = append(response.Errors, err.Error())
+		return response, fmt.Errorf("failed to record notification: %w", err)
+	}
+	s.recordAttempts(req.NotificationID, res)
+	s.recordDeliveries(req.NotificationID, devices, res)
+
+	return response, nil
+}
+
+// SendToPlayers sends a push notification to specific player IDs
+func (s *pushService) SendToPlayers(playerIDs []string, title, message string, data map[string]interface{}) (*client.SendResult, error) {
+	targets := make([]client.Device, 0, len(playerIDs))
+	for _, playerID := range playerIDs {
+		targets = append(targets, client.Device{
+			Addresses: map[string]string{client.ProviderOneSignal: playerID},
+		})
+	}
+	return s.provider.SendToDevices(targets, &client.PushMessage{Title: title, Message: message, Data: data})
+}
+
+// SendToSegment sends a push notification to a segment
+func (s *pushService) SendToSegment(segment, title, message string, data map[string]interface{}) (*client.SendResult, error) {
+	if !s.provider.Capabilities().Segments {
+		return nil, fmt.Errorf("provider %s does not support segments", s.provider.Name())
+	}
+	return s.provider.SendToSegment(segment, &client.PushMessage{Title: title, Message: message, Data: data})
+}
+
+// GetPlayers fetches registered devices from the provider
+func (s *pushService) GetPlayers(limit, offset int) (*client.PlayersResponse, error) {
+	if !s.provider.Capabilities().DeviceListing {
+		return nil, fmt.Errorf("provider %s does not support device listing", s.provider.Name())
+	}
+	return s.provider.ListDevices(limit, offset)
+}
+
+// toProviderDevices converts stored devices into delivery targets carrying
+// every provider address the device is reachable at
+func toProviderDevices(devices []models.UserDevice) []client.Device {
+	targets := make([]client.Device, 0, len(devices))
+	for _, device := range devices {
+		target := client.Device{
+			Addresses: deviceAddresses(device),
+			Platform:  device.Platform,
+			Locale:    device.Locale,
+		}
+		if device.WebPushEndpoint != "" {
+			target.WebPush = &client.WebPushSubscription{
+				Endpoint: device.WebPushEndpoint,
+				P256dh:   device.WebPushP256dh,
+				Auth:     device.WebPushAuth,
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// deactivateUnregisteredDevices disables devices whose tokens the provider rejected as invalid
+func (s *pushService) deactivateUnregisteredDevices(res *client.SendResult) {
+	if res == nil {
+		return
+	}
+	for provider, tokens := range res.UnregisteredTokens() {
+		log.Printf("Deactivating %d unregistered device(s) reported by %s", len(tokens), provider)
+		var err error
+		if provider == client.ProviderOneSignal {
+			err = s.pushRepo.DeactivateDevicesByPlayerIDs(tokens)
+		} else {
+			err = s.pushRepo.DeactivateDevicesByTokens(provider, tokens)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to deactivate unregistered devices: %v", err)
+		}
+	}
+}
 
-		// Create notification log for failed attempt
-		notifID := req.NotificationID
-		if notifID == "" {
-			notifID = uuid.New().String()
+// recordAttempts stores the provider calls the router made for a notification
+func (s *pushService) recordAttempts(notificationID string, res *client.SendResult) {
+	if res == nil || len(res.Attempts) == 0 {
+		return
+	}
+	attempts := make([]models.NotificationAttempt, 0, len(res.Attempts))
+	for _, a := range res.Attempts {
+		attempt := models.NotificationAttempt{
+			NotificationID: notificationID,
+			Provider:       a.Provider,
+			Devices:        a.Devices,
+			Recipients:     a.Recipients,
+			Fallback:       a.Fallback,
+			DurationMs:     a.Duration.Milliseconds(),
 		}
-		errorMsg := fmt.Sprintf("no active devices for user: %s", req.UserID)
-		notificationLog := &models.NotificationLog{
-			NotificationID: notifID,
-			UserID:         req.UserID,
+		if a.Error != "" {
+			errMsg := a.Error
+			attempt.Error = &errMsg
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err := s.pushRepo.CreateNotificationAttempts(attempts); err != nil {
+		log.Printf("Warning: Failed to record provider attempts: %v", err)
+	}
+}
+
+// recordDeliveries stores one delivery row per device, matched to the provider
+// results by address. A device that failed over carries the outcome of its last attempt.
+func (s *pushService) recordDeliveries(notificationID string, devices []models.UserDevice, res *client.SendResult) {
+	now := time.Now()
+	deliveries := make([]models.NotificationDelivery, len(devices))
+	byAddress := make(map[string]int)
+	for i, device := range devices {
+		errMsg := client.ErrNoRoute.Error()
+		deliveries[i] = models.NotificationDelivery{
+			NotificationID: notificationID,
+			DeviceID:       device.ID,
+			Platform:       device.Platform,
 			Status:         string(dto.NotificationStatusFailed),
-			Recipients:     0,
-			Error:          &errorMsg,
+			Error:          &errMsg,
 		}
-		if err := s.pushRepo.CreateNotificationLog(notificationLog); err != nil {
-			log.Printf("Warning: Failed to create notification log: %v", err)
+		for provider, token := range deviceAddresses(device) {
+			byAddress[provider+":"+token] = i
 		}
+	}
 
-		return &dto.PushResponse{
-			Success: false,
-			Message: "No active devices found for user",
-		}, nil
+	if res != nil {
+		for _, result := range res.Results {
+			i, ok := byAddress[result.Provider+":"+result.Token]
+			if !ok {
+				continue
+			}
+			d := &deliveries[i]
+			d.Attempts++
+			d.Provider = result.Provider
+			d.ProviderMessageID = result.MessageID
+			d.ErrorCode = result.ErrorCode
+			if result.Error != "" {
+				errMsg := result.Error
+				d.Status = string(dto.NotificationStatusFailed)
+				d.Error = &errMsg
+				d.SentAt = nil
+			} else {
+				d.Status = string(dto.NotificationStatusSent)
+				d.Error = nil
+				d.SentAt = &now
+			}
+		}
 	}
 
-	// Extract player IDs
-	playerIDs := make([]string, 0, len(devices))
-	for _, device := range devices {
-		playerIDs = append(playerIDs, device.PlayerID)
+	if err := s.pushRepo.CreateNotificationDeliveries(deliveries); err != nil {
+		log.Printf("Warning: Failed to record device deliveries: %v", err)
 	}
+}
+
+// deviceAddresses returns every provider token the device can be reached with
+func deviceAddresses(device models.UserDevice) map[string]string {
+	addresses := make(map[string]string)
+	if device.PlayerID != nil && *device.PlayerID != "" {
+		addresses[client.ProviderOneSignal] = *device.PlayerID
+	}
+	if device.Provider != "" && device.Token != "" {
+		addresses[device.Provider] = device.Token
+	}
+	return addresses
+}
+
+// newPushMessage builds the provider-agnostic message for a push request
+func newPushMessage(req *dto.PushRequest) *client.PushMessage {
+	msg := &client.PushMessage{
+		Title:            req.Title,
+		Message:          req.Message,
+		Data:             req.Data,
+		Priority:         req.Priority,
+		ExternalID:       req.NotificationID,
+		Titles:           req.Titles,
+		Messages:         req.Messages,
+		ImageURL:         req.ImageURL,
+		URL:              req.URL,
+		DeepLink:         req.DeepLink,
+		Sound:            req.Sound,
+		BadgeIncrement:   req.BadgeIncrement,
+		AndroidChannelID: req.AndroidChannelID,
+		Group:            req.Group,
+	}
+	if req.Silent {
+		msg.PushType = client.APNsPushTypeBackground
+	}
+	if req.TTL != nil {
+		ttl := time.Duration(*req.TTL) * time.Second
+		msg.TTL = &ttl
+	}
+	msg.CollapseID = req.CollapseID
+	for _, button := range req.Buttons {
+		msg.Buttons = append(msg.Buttons, client.Button{ID: button.ID, Text: button.Text, Icon: button.Icon, URL: button.URL})
+	}
+	return msg
+}
 
-	log.Printf("Sending notification to %d device(s) for user %s", len(playerIDs), req.UserID)
+// applyTemplate renders the request's template in the default locale's language and
+// in every language the user's devices are in, as the request's title, message and
+// per-language content. A language the template cannot be rendered in is skipped so
+// its devices fall back to another one.
+func (s *pushService) applyTemplate(req *dto.PushRequest, devices []models.UserDevice) error {
+	if req.TemplateID == "" {
+		return nil
+	}
 
-	res, err := s.oneSignalClient.SendToUsers(playerIDs, req.Title, req.Message, req.Data)
+	defaultLanguage := templateLanguage(s.cfg.DefaultLocale)
+	rendered, err := s.templates.Render(req.TemplateID, defaultLanguage, req.TemplateVars)
 	if err != nil {
-		log.Printf("Failed to send notification: %v", err)
+		return err
+	}
+	if rendered.Content == "" {
+		return apperrors.Validation("template %s rendered an empty body", req.TemplateID)
+	}
+	if rendered.Subject != "" {
+		req.Title = rendered.Subject
+	}
+	req.Message = rendered.Content
 
-		// Create notification log for failed attempt
-		notifID := req.NotificationID
-		if notifID == "" {
-			notifID = uuid.New().String()
+	for _, language := range deviceLanguages(devices) {
+		if language == defaultLanguage {
+			continue
 		}
-		errorMsg := err.Error()
-		notificationLog := &models.NotificationLog{
-			NotificationID: notifID,
-			UserID:         req.UserID,
-			Status:         string(dto.NotificationStatusFailed),
-			Recipients:     0,
-			Error:          &errorMsg,
+		localized, err := s.templates.Render(req.TemplateID, language, req.TemplateVars)
+		if errors.Is(err, apperrors.ErrValidation) || errors.Is(err, apperrors.ErrNotFound) {
+			log.Printf("Template %s not rendered in %s: %v", req.TemplateID, language, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if localized.Content == "" {
+			continue
+		}
+		if req.Messages == nil {
+			req.Messages = make(map[string]string)
 		}
-		if logErr := s.pushRepo.CreateNotificationLog(notificationLog); logErr != nil {
-			log.Printf("Warning: Failed to create notification log: %v", logErr)
+		req.Messages[language] = localized.Content
+		if localized.Subject != "" {
+			if req.Titles == nil {
+				req.Titles = make(map[string]string)
+			}
+			req.Titles[language] = localized.Subject
+		}
+	}
+	return nil
+}
+
+// deviceLanguages returns the distinct template languages of the devices' locales
+func deviceLanguages(devices []models.UserDevice) []string {
+	seen := make(map[string]bool)
+	var languages []string
+	for _, device := range devices {
+		language := templateLanguage(device.Locale)
+		if language != "" && !seen[language] {
+			seen[language] = true
+			languages = append(languages, language)
 		}
+	}
+	return languages
+}
+
+// templateLanguage maps a locale onto the template service's language, e.g. pt for pt-BR
+func templateLanguage(locale string) string {
+	language, _, _ := strings.Cut(normalizeLocale(locale), "-")
+	return language
+}
+
+// ensureNotificationID gives requests without a caller notification_id one of our own,
+// so the log is always keyed by our ID and never by the provider's
+func ensureNotificationID(req *dto.PushRequest) {
+	if req.NotificationID == "" {
+		req.NotificationID = uuid.New().String()
+	}
+}
 
-		return &dto.PushResponse{
-			Success: false,
-			Message: "Failed to send notification",
-			Errors:  []string{err.Error()},
-		}, err
+// deviceErrorSummary flattens per-device failures into a NotificationLog error
+func deviceErrorSummary(res *client.SendResult) *string {
+	if len(res.Errors) == 0 {
+		return nil
 	}
+	summary := strings.Join(res.Errors, "; ")
+	return &summary
+}
 
-	log.Printf("Notification sent successfully. ID: %s, Recipients: %d", res.ID, res.Recipients)
+// openNotification logs an accepted push as queued, storing its status event in the
+// outbox in the same transaction. A notification still queued or sending from an
+// earlier attempt that did not finish is picked up again as is.
+func (s *pushService) openNotification(req *dto.PushRequest) error {
+	existing, err := s.pushRepo.GetNotificationLog(req.NotificationID)
+	if err == nil {
+		switch dto.NotificationStatus(existing.Status) {
+		case dto.NotificationStatusQueued, dto.NotificationStatusSending:
+			return nil
+		default:
+			return apperrors.Conflict("notification %s is already %s", req.NotificationID, existing.Status)
+		}
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("failed to fetch notification %s: %w", req.NotificationID, err)
+	}
 
-	// Create notification log
 	notificationLog := &models.NotificationLog{
-		NotificationID: res.ID,
+		NotificationID: req.NotificationID,
 		UserID:         req.UserID,
-		Status:         string(dto.NotificationStatusPending),
-		Recipients:     res.Recipients,
+		CorrelationID:  req.CorrelationID,
+		Kind:           req.Kind(),
+		Status:         string(dto.NotificationStatusQueued),
+	}
+	return s.pushRepo.Transaction(func(repo repository.PushRepository) error {
+		if err := repo.CreateNotificationLog(notificationLog); err != nil {
+			return fmt.Errorf("failed to create notification log: %w", err)
+		}
+		if err := repo.CreateStatusChange(&models.NotificationStatusChange{
+			NotificationID: notificationLog.NotificationID,
+			ToStatus:       notificationLog.Status,
+			Source:         StatusSourceSend,
+		}); err != nil {
+			return fmt.Errorf("failed to record status change: %w", err)
+		}
+		return s.enqueueStatusEvent(repo, notificationLog)
+	})
+}
+
+// failureResponse is the result returned and stored for a notification that could not be sent
+func failureResponse(notificationID, message string, err error) *dto.PushResponse {
+	response := &dto.PushResponse{
+		Success:        false,
+		NotificationID: notificationID,
+		Message:        message,
 	}
-	if err := s.pushRepo.CreateNotificationLog(notificationLog); err != nil {
-		log.Printf("Warning: Failed to create notification log: %v", err)
-		// Don't fail the request if logging fails
+	if err != nil {
+		response.Errors = []string{err.Error()}
 	}
+	return response
+}
 
-	return &dto.PushResponse{
-		Success:        true,
-		NotificationID: res.ID,
-		Recipients:     res.Recipients,
-		Errors:         res.GetErrors(),
-		Message:        "Notification sent successfully",
-	}, nil
+// recordSent moves a notification to sent with the provider's outcome. The push has
+// already gone out, so a database error is retried a few times before giving up.
+func (s *pushService) recordSent(notificationID string, res *client.SendResult) error {
+	errMsg := deviceErrorSummary(res)
+	var err error
+	for attempt := 0; attempt < recordSentAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(recordSentBackoff << (attempt - 1))
+		}
+		err = s.applyTransition(notificationID, dto.NotificationStatusSent, errMsg, StatusSourceSend, func(notificationLog *models.NotificationLog) {
+			notificationLog.ProviderMessageID = res.ID
+			notificationLog.Recipients = res.Recipients
+			notificationLog.Provider = res.Provider
+			notificationLog.Error = errMsg // clears the error of an earlier failed attempt
+		})
+		if err == nil || errors.Is(err, apperrors.ErrConflict) || errors.Is(err, apperrors.ErrNotFound) {
+			return err
+		}
+	}
+	return err
 }
 
-// SendToPlayers sends a push notification to specific player IDs
-func (s *pushService) SendToPlayers(playerIDs []string, title, message string, data map[string]interface{}) (*client.OneSignalResponse, error) {
-	return s.oneSignalClient.SendToUsers(playerIDs, title, message, data)
+// recoverSent records a send whose idempotency claim was completed but whose log could
+// not be moved to sent at the time. It reports whether it recorded anything.
+func (s *pushService) recoverSent(notificationID string, response *dto.PushResponse) (bool, error) {
+	if response.ProviderMessageID == "" && response.Recipients == 0 {
+		return false, nil
+	}
+	notificationLog, err := s.pushRepo.GetNotificationLog(notificationID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch notification %s: %w", notificationID, err)
+	}
+	switch dto.NotificationStatus(notificationLog.Status) {
+	case dto.NotificationStatusQueued, dto.NotificationStatusSending:
+	default:
+		return false, nil
+	}
+
+	err = s.recordSent(notificationID, &client.SendResult{
+		Provider:   response.Provider,
+		ID:         response.ProviderMessageID,
+		Recipients: response.Recipients,
+		Errors:     response.Errors,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to record notification %s: %w", notificationID, err)
+	}
+	log.Printf("Recorded notification %s as sent from its completed claim", notificationID)
+	return true, nil
 }
 
-// SendToSegment sends a push notification to a segment
-func (s *pushService) SendToSegment(segment, title, message string, data map[string]interface{}) (*client.OneSignalResponse, error) {
-	return s.oneSignalClient.SendToSegment(segment, title, message, data)
+// recordFailure moves a notification that could not be sent back to queued when the
+// failure is worth retrying, or to failed when it is final
+func (s *pushService) recordFailure(notificationID string, cause error) {
+	next := dto.NotificationStatusFailed
+	if apperrors.IsRetryable(cause) {
+		next = dto.NotificationStatusQueued
+	}
+	errMsg := cause.Error()
+	if err := s.transitionStatus(notificationID, next, &errMsg, StatusSourceSend); err != nil {
+		log.Printf("Warning: Failed to record notification %s as %s: %v", notificationID, next, err)
+	}
 }
 
-// GetPlayers fetches players from OneSignal
-func (s *pushService) GetPlayers(limit, offset int) (*client.PlayersResponse, error) {
-	return s.oneSignalClient.GetPlayers(limit, offset)
+// enqueueStatusEvent writes the notification's current status event to the outbox
+// for the gateway and other services, carrying the original correlation ID
+func (s *pushService) enqueueStatusEvent(repo repository.PushRepository, notificationLog *models.NotificationLog) error {
+	if s.producer == nil {
+		return nil
+	}
+	event := dto.NotificationStatusEvent{
+		NotificationID: notificationLog.NotificationID,
+		UserID:         notificationLog.UserID,
+		Kind:           notificationLog.Kind,
+		Status:         dto.NotificationStatus(notificationLog.Status),
+		Provider:       notificationLog.Provider,
+		Recipients:     notificationLog.Recipients,
+		Error:          notificationLog.Error,
+		CorrelationID:  notificationLog.CorrelationID,
+		Timestamp:      time.Now().UTC(),
+	}
+	env, err := s.producer.NewStatusEvent(notificationLog.Status, event, notificationLog.CorrelationID)
+	if err != nil {
+		return fmt.Errorf("failed to build status event: %w", err)
+	}
+	if err := repo.CreateOutboxMessage(&models.OutboxMessage{
+		MessageID:     env.MessageID,
+		Exchange:      env.Exchange,
+		RoutingKey:    env.RoutingKey,
+		CorrelationID: env.CorrelationID,
+		Payload:       string(env.Body),
+	}); err != nil {
+		return fmt.Errorf("failed to enqueue status event: %w", err)
+	}
+	return nil
 }
 
 func (s *pushService) GetHealth() (*dto.GetHealthResponse, error) {
 	// Get RabbitMQ health status
 	rabbitStatus := "disconnected"
-	if s.bunnyConn != nil && !s.bunnyConn.IsClosed() {
-		rabbitStatus = "connected"
+	var rabbitDetails *dto.BrokerStatus
+	if s.bunnyConn != nil {
+		conn := s.bunnyConn.Status()
+		rabbitStatus = conn.State
+		rabbitDetails = &dto.BrokerStatus{
+			State:      conn.State,
+			Reconnects: conn.Reconnects,
+			LastError:  conn.LastError,
+			Since:      conn.Since,
+		}
 	}
 	// Get PostgreSQL health status
 	postgresStatus := "disconnected"
@@ -296,11 +854,14 @@ func (s *pushService) GetHealth() (*dto.GetHealthResponse, error) {
 	status := "healthy"
 	if rabbitStatus != "connected" && postgresStatus != "connected" {
 		status = "unhealthy"
+	} else if rabbitStatus == queue.StateReconnecting {
+		status = "degraded"
 	}
 
 	deps := dto.DependenciesStatus{
-		RabbitMQ:   rabbitStatus,
-		PostgreSQL: postgresStatus,
+		RabbitMQ:        rabbitStatus,
+		RabbitMQDetails: rabbitDetails,
+		PostgreSQL:      postgresStatus,
 	}
 
 	response := dto.GetHealthResponse{
@@ -313,43 +874,152 @@ func (s *pushService) GetHealth() (*dto.GetHealthResponse, error) {
 	return &response, nil
 }
 
-// UpdateNotificationStatus updates the status of a notification
+// UpdateNotificationStatus moves a notification to a new status. Unknown statuses are
+// rejected as invalid and transitions the lifecycle does not allow as conflicts.
 func (s *pushService) UpdateNotificationStatus(req *dto.NotificationStatusUpdate) error {
-	log, err := s.pushRepo.GetNotificationLog(req.NotificationID)
+	if !req.Status.Valid() {
+		return apperrors.Validation("unknown notification status: %q", req.Status)
+	}
+	return s.transitionStatus(req.NotificationID, req.Status, req.Error, StatusSourceAPI)
+}
+
+// transitionStatus applies a status change, records it in the history and enqueues
+// its status event in one transaction. Repeating the current status is a no-op.
+func (s *pushService) transitionStatus(notificationID string, next dto.NotificationStatus, errMsg *string, source string) error {
+	return s.applyTransition(notificationID, next, errMsg, source, nil)
+}
+
+// applyTransition is transitionStatus with update applied to the log before it is saved
+func (s *pushService) applyTransition(notificationID string, next dto.NotificationStatus, errMsg *string, source string, update func(*models.NotificationLog)) error {
+	notificationLog, err := s.pushRepo.GetNotificationLog(notificationID)
 	if err != nil {
-		return fmt.Errorf("notification not found: %w", err)
+		return notificationLookupError(err)
 	}
 
-	// Update status
-	log.Status = string(req.Status)
-	if req.Error != nil {
-		log.Error = req.Error
+	current := dto.NotificationStatus(notificationLog.Status)
+	if current == next {
+		return nil
+	}
+	if !current.CanTransitionTo(next) {
+		return apperrors.Conflict("notification %s cannot move from %s to %s", notificationLog.NotificationID, current, next)
 	}
-	log.UpdatedAt = time.Now()
 
-	// Save to database
-	if err := s.pushRepo.UpdateNotificationLog(log); err != nil {
-		return fmt.Errorf("failed to update notification log: %w", err)
+	notificationLog.Status = string(next)
+	if errMsg != nil {
+		notificationLog.Error = errMsg
 	}
+	if update != nil {
+		update(notificationLog)
+	}
+	notificationLog.UpdatedAt = time.Now()
 
-	return nil
+	return s.pushRepo.Transaction(func(repo repository.PushRepository) error {
+		updated, err := repo.TransitionNotificationLog(notificationLog, string(current))
+		if err != nil {
+			return fmt.Errorf("failed to update notification log: %w", err)
+		}
+		if !updated {
+			return apperrors.Conflict("notification %s changed status concurrently", notificationLog.NotificationID)
+		}
+		if err := repo.CreateStatusChange(&models.NotificationStatusChange{
+			NotificationID: notificationLog.NotificationID,
+			FromStatus:     string(current),
+			ToStatus:       notificationLog.Status,
+			Source:         source,
+			Error:          errMsg,
+		}); err != nil {
+			return fmt.Errorf("failed to record status change: %w", err)
+		}
+		return s.enqueueStatusEvent(repo, notificationLog)
+	})
 }
 
 // GetNotificationStatus retrieves the status of a notification
 func (s *pushService) GetNotificationStatus(notificationID string) (*dto.NotificationStatusResponse, error) {
-	log, err := s.pushRepo.GetNotificationLog(notificationID)
+	notificationLog, err := s.pushRepo.GetNotificationLog(notificationID)
 	if err != nil {
-		return nil, fmt.Errorf("notification not found: %w", err)
+		return nil, notificationLookupError(err)
 	}
 
 	response := &dto.NotificationStatusResponse{
-		NotificationID: log.NotificationID,
-		Status:         dto.NotificationStatus(log.Status),
-		Timestamp:      log.UpdatedAt,
-		Error:          log.Error,
-		UserID:         log.UserID,
-		Recipients:     log.Recipients,
+		NotificationID:    notificationLog.NotificationID,
+		ProviderMessageID: notificationLog.ProviderMessageID,
+		Kind:              notificationLog.Kind,
+		Status:            dto.NotificationStatus(notificationLog.Status),
+		Timestamp:         notificationLog.UpdatedAt,
+		Error:             notificationLog.Error,
+		UserID:            notificationLog.UserID,
+		Recipients:        notificationLog.Recipients,
+		Provider:          notificationLog.Provider,
+	}
+
+	attempts, err := s.pushRepo.GetNotificationAttempts(notificationLog.NotificationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch provider attempts: %w", err)
+	}
+	for _, a := range attempts {
+		response.Attempts = append(response.Attempts, dto.ProviderAttempt{
+			Provider:   a.Provider,
+			Devices:    a.Devices,
+			Recipients: a.Recipients,
+			Fallback:   a.Fallback,
+			Error:      a.Error,
+			DurationMs: a.DurationMs,
+			Timestamp:  a.CreatedAt,
+		})
+	}
+
+	history, err := s.pushRepo.GetStatusHistory(notificationLog.NotificationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch status history: %w", err)
+	}
+	for _, h := range history {
+		response.History = append(response.History, dto.StatusChange{
+			From:      dto.NotificationStatus(h.FromStatus),
+			To:        dto.NotificationStatus(h.ToStatus),
+			Source:    h.Source,
+			Error:     h.Error,
+			Timestamp: h.CreatedAt,
+		})
+	}
+
+	deliveries, err := s.pushRepo.GetNotificationDeliveries(notificationLog.NotificationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch device deliveries: %w", err)
+	}
+	for _, d := range deliveries {
+		response.Deliveries = append(response.Deliveries, dto.DeviceDelivery{
+			DeviceID:          d.DeviceID,
+			Platform:          d.Platform,
+			Provider:          d.Provider,
+			ProviderMessageID: d.ProviderMessageID,
+			Status:            dto.NotificationStatus(d.Status),
+			ErrorCode:         d.ErrorCode,
+			Error:             d.Error,
+			Attempts:          d.Attempts,
+			SentAt:            d.SentAt,
+			DeliveredAt:       d.DeliveredAt,
+			ClickedAt:         d.ClickedAt,
+			DismissedAt:       d.DismissedAt,
+			Timestamp:         d.UpdatedAt,
+		})
 	}
 
 	return response, nil
 }
+
+// GetVAPIDPublicKey returns the application server key browsers subscribe with
+func (s *pushService) GetVAPIDPublicKey() (*dto.VAPIDPublicKeyResponse, error) {
+	if s.cfg.VAPIDPublicKey == "" {
+		return nil, fmt.Errorf("web push is not configured")
+	}
+	return &dto.VAPIDPublicKeyResponse{PublicKey: s.cfg.VAPIDPublicKey}, nil
+}
+
+// notificationLookupError distinguishes a missing notification log from a database failure
+func notificationLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apperrors.NotFound("notification not found: %w", err)
+	}
+	return fmt.Errorf("failed to fetch notification: %w", err)
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/client"
+	"github.com/whotterre/push_microservice/internal/dto"
+	"github.com/whotterre/push_microservice/internal/models"
+)
+
+func TestProcessSendMessageRecordsFailedAttempts(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "ios", IsActive: true})
+	provider := &fakeProvider{outcomes: []fakeOutcome{{
+		res: &client.SendResult{
+			Provider: client.ProviderOneSignal,
+			Results: []client.DeviceResult{
+				{Provider: client.ProviderOneSignal, Token: playerID, ErrorCode: "invalid_request", Error: "rejected"},
+			},
+			Attempts: []client.ProviderAttempt{{Provider: client.ProviderOneSignal, Devices: 1, Error: "rejected"}},
+		},
+		err: apperrors.Permanent(errors.New("onesignal: rejected")),
+	}}}
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), provider)
+
+	err := s.ProcessSendMessage([]byte(`{"notification_id":"notif-3","user_id":"user-1","title":"Hi","message":"Hello"}`), "corr-1", "", time.Time{})
+	if !errors.Is(err, apperrors.ErrProviderPermanent) {
+		t.Fatalf("err = %v, want a permanent provider error", err)
+	}
+
+	notificationLog, _ := repo.GetNotificationLog("notif-3")
+	if notificationLog.Status != string(dto.NotificationStatusFailed) {
+		t.Errorf("log is %s, want failed", notificationLog.Status)
+	}
+	if attempts, _ := repo.GetNotificationAttempts("notif-3"); len(attempts) != 1 {
+		t.Errorf("recorded %d attempts, want 1", len(attempts))
+	}
+	deliveries, _ := repo.GetNotificationDeliveries("notif-3")
+	if len(deliveries) != 1 || deliveries[0].Status != string(dto.NotificationStatusFailed) || deliveries[0].ErrorCode != "invalid_request" {
+		t.Errorf("deliveries = %+v, want one failed delivery with its error code", deliveries)
+	}
+}
+
+func TestProcessSendMessageRecordsSentOutcomeOnRedelivery(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "web", IsActive: true})
+	repo.failSentTransitions = recordSentAttempts
+	claims := newFakeIdempotencyRepo()
+	provider := &fakeProvider{outcomes: []fakeOutcome{{
+		res: &client.SendResult{Provider: client.ProviderOneSignal, ID: "os-4", Recipients: 1},
+	}}}
+	s := newTestPushService(repo, claims, provider)
+	body := []byte(`{"notification_id":"notif-4","user_id":"user-1","title":"Hi","message":"Hello"}`)
+
+	err := s.ProcessSendMessage(body, "corr-4", "", time.Time{})
+	if err == nil || !apperrors.IsRetryable(err) {
+		t.Fatalf("err = %v, want a retryable error while the database is down", err)
+	}
+	if claim := claims.claims["notif-4"]; claim == nil || claim.Status != models.IdempotencyCompleted {
+		t.Fatal("claim was not completed although the provider accepted the push")
+	}
+
+	// The redelivery does not send again but records the outcome stored in the claim
+	if err := s.ProcessSendMessage(body, "corr-4", "", time.Time{}); err != nil {
+		t.Fatalf("redelivery: %v", err)
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider called %d times, want 1", provider.calls)
+	}
+	notificationLog, _ := repo.GetNotificationLog("notif-4")
+	if notificationLog.Status != string(dto.NotificationStatusSent) || notificationLog.ProviderMessageID != "os-4" || notificationLog.Provider != client.ProviderOneSignal {
+		t.Errorf("log = %s/%q/%q, want sent/os-4/onesignal", notificationLog.Status, notificationLog.ProviderMessageID, notificationLog.Provider)
+	}
+}
+
+func TestProcessSendMessageRetryKeepsTheOriginalDeadline(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "android", IsActive: true})
+	provider := &fakeProvider{outcomes: []fakeOutcome{
+		{err: apperrors.Transient(errors.New("onesignal: unavailable"))},
+		{res: &client.SendResult{Provider: client.ProviderOneSignal, ID: "os-5", Recipients: 1}},
+	}}
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), provider)
+	body := []byte(`{"notification_id":"notif-5","user_id":"user-1","title":"Hi","message":"Hello","ttl":600}`)
+
+	if err := s.ProcessSendMessage(body, "corr-5", "", time.Time{}); !apperrors.IsRetryable(err) {
+		t.Fatalf("err = %v, want a retryable error", err)
+	}
+	if ttl := provider.messages[0].TTL; ttl == nil || *ttl != 600*time.Second {
+		t.Errorf("first attempt ttl = %v, want 10m", ttl)
+	}
+
+	// The retry is sent with what is left of the ttl, not the full ttl again
+	if err := s.ProcessSendMessage(body, "corr-5", "", time.Now().Add(90*time.Second)); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if ttl := provider.messages[1].TTL; ttl == nil || *ttl > 90*time.Second || *ttl < 80*time.Second {
+		t.Errorf("retry ttl = %v, want what is left of the deadline", ttl)
+	}
+}
+
+func TestProcessSendMessageExpiresRetryPastItsDeadline(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "android", IsActive: true})
+	provider := &fakeProvider{outcomes: []fakeOutcome{
+		{err: apperrors.Transient(errors.New("onesignal: unavailable"))},
+	}}
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), provider)
+	body := []byte(`{"notification_id":"notif-6","user_id":"user-1","title":"Hi","message":"Hello","ttl":0}`)
+
+	if err := s.ProcessSendMessage(body, "corr-6", "", time.Time{}); !apperrors.IsRetryable(err) {
+		t.Fatalf("err = %v, want a retryable error", err)
+	}
+	// Under a second left would be a ttl of 0, which providers read as now-or-never
+	if err := s.ProcessSendMessage(body, "corr-6", "", time.Now().Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("retry at the deadline: %v, want it dropped", err)
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider called %d times, want 1", provider.calls)
+	}
+	notificationLog, _ := repo.GetNotificationLog("notif-6")
+	if notificationLog.Status != string(dto.NotificationStatusExpired) {
+		t.Errorf("log is %s, want expired", notificationLog.Status)
+	}
+}
+
+func TestProcessSendMessageExpiresRedeliveryStuckInSending(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "android", IsActive: true})
+	provider := &fakeProvider{}
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), provider)
+	body := []byte(`{"notification_id":"notif-7","user_id":"user-1","title":"Hi","message":"Hello","ttl":60}`)
+
+	// A worker died mid-send, leaving the log in sending, and the redelivery comes too late
+	if err := repo.CreateNotificationLog(&models.NotificationLog{NotificationID: "notif-7", Kind: dto.NotificationKindAlert, Status: string(dto.NotificationStatusSending)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ProcessSendMessage(body, "corr-7", "", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("redelivery past the deadline: %v, want it dropped", err)
+	}
+	if provider.calls != 0 {
+		t.Errorf("provider called %d times, want 0", provider.calls)
+	}
+	notificationLog, _ := repo.GetNotificationLog("notif-7")
+	if notificationLog.Status != string(dto.NotificationStatusExpired) {
+		t.Errorf("log is %s, want expired", notificationLog.Status)
+	}
+}
+
+func TestProcessSendMessageForCancelledNotificationIsFinal(t *testing.T) {
+	repo := newFakePushRepo()
+	claims := newFakeIdempotencyRepo()
+	s := newTestPushService(repo, claims, &fakeProvider{})
+	if err := repo.CreateNotificationLog(&models.NotificationLog{NotificationID: "notif-8", Kind: dto.NotificationKindAlert, Status: string(dto.NotificationStatusCancelled)}); err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"notification_id":"notif-8","user_id":"user-1","title":"Hi","message":"Hello"}`)
+
+	err := s.ProcessSendMessage(body, "corr-8", "", time.Time{})
+	if !errors.Is(err, apperrors.ErrConflict) || apperrors.IsRetryable(err) {
+		t.Fatalf("err = %v, want a final conflict", err)
+	}
+
+	// A claim held by another attempt is worth retrying
+	if _, _, err := claims.Claim("notif-9", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	err = s.ProcessSendMessage([]byte(`{"notification_id":"notif-9","user_id":"user-1","title":"Hi","message":"Hello"}`), "corr-9", "", time.Time{})
+	if !errors.Is(err, apperrors.ErrInProgress) || !apperrors.IsRetryable(err) {
+		t.Errorf("err = %v, want a retryable in-progress error", err)
+	}
+}
+
+func TestProcessSendMessageWithoutIDClaimsTheGivenID(t *testing.T) {
+	playerID := "player-1"
+	repo := newFakePushRepo(models.UserDevice{ID: 1, UserID: "user-1", PlayerID: &playerID, Platform: "android", IsActive: true})
+	provider := &fakeProvider{outcomes: []fakeOutcome{
+		{res: &client.SendResult{Provider: client.ProviderOneSignal, ID: "os-10", Recipients: 1}},
+	}}
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), provider)
+	body := []byte(`{"user_id":"user-1","title":"Hi","message":"Hello"}`)
+
+	// A redelivery of a request without an ID is claimed under the same one and not sent again
+	for range 2 {
+		if err := s.ProcessSendMessage(body, "corr-10", "notif-10", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if provider.calls != 1 {
+		t.Errorf("provider called %d times, want 1", provider.calls)
+	}
+	if _, err := repo.GetNotificationLog("notif-10"); err != nil {
+		t.Errorf("no log under the given ID: %v", err)
+	}
+}
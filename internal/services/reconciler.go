@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/client"
+	"github.com/whotterre/push_microservice/internal/dto"
+	"github.com/whotterre/push_microservice/internal/models"
+)
+
+// Reconciler moves sent notifications on to their final status without waiting for
+// someone to call POST /push/status: it polls the provider for delivery outcomes and
+// expires notifications that never got one.
+type Reconciler struct {
+	pushService PushService
+	interval    time.Duration
+	batchSize   int
+	expireAfter time.Duration
+}
+
+func NewReconciler(pushService PushService, interval time.Duration, batchSize int, expireAfter time.Duration) *Reconciler {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if expireAfter <= 0 {
+		expireAfter = 72 * time.Hour
+	}
+	return &Reconciler{
+		pushService: pushService,
+		interval:    interval,
+		batchSize:   batchSize,
+		expireAfter: expireAfter,
+	}
+}
+
+// Run reconciles one batch and expires stale notifications every interval until ctx is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Shutting down reconciler...")
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := r.pushService.ReconcileNotifications(r.batchSize); err != nil {
+			log.Printf("Reconciler: %v", err)
+		}
+		if _, err := r.pushService.ExpireStaleNotifications(r.expireAfter, r.batchSize); err != nil {
+			log.Printf("Reconciler: %v", err)
+		}
+	}
+}
+
+// ReconcileNotifications fetches the outcome of up to limit sent OneSignal notifications,
+// stores the counts and moves finished ones to delivered or failed. It stops at the
+// first error that is not specific to one notification, e.g. throttling.
+func (s *pushService) ReconcileNotifications(limit int) (int, error) {
+	reporter, ok := s.reporter(client.ProviderOneSignal)
+	if !ok {
+		return 0, nil
+	}
+
+	// Silent pushes get no delivery report, so only alerts are reconciled
+	logs, err := s.pushRepo.GetNotificationsToReconcile(dto.NotificationKindAlert, client.ProviderOneSignal, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch notifications to reconcile: %w", err)
+	}
+
+	reconciled := 0
+	for i := range logs {
+		notificationLog := &logs[i]
+		messageIDs, err := s.providerMessageIDs(notificationLog.NotificationID, client.ProviderOneSignal)
+		if err != nil {
+			return reconciled, fmt.Errorf("failed to fetch deliveries of notification %s: %w", notificationLog.NotificationID, err)
+		}
+		report, done, err := fetchReports(reporter, messageIDs)
+		now := time.Now()
+		if errors.Is(err, apperrors.ErrProviderPermanent) {
+			// e.g. OneSignal no longer knows the notification; skip it until it expires
+			log.Printf("Cannot reconcile notification %s: %v", notificationLog.NotificationID, err)
+			notificationLog.ReconciledAt = &now
+			if err := s.pushRepo.UpdateNotificationCounts(notificationLog); err != nil {
+				return reconciled, fmt.Errorf("failed to update notification %s: %w", notificationLog.NotificationID, err)
+			}
+			continue
+		}
+		if err != nil {
+			return reconciled, fmt.Errorf("failed to fetch report for notification %s: %w", notificationLog.NotificationID, err)
+		}
+
+		notificationLog.Successful = report.Successful
+		notificationLog.Failed = report.Failed
+		notificationLog.Errored = report.Errored
+		notificationLog.Converted = report.Converted
+		notificationLog.ReconciledAt = &now
+		if err := s.pushRepo.UpdateNotificationCounts(notificationLog); err != nil {
+			return reconciled, fmt.Errorf("failed to update notification %s: %w", notificationLog.NotificationID, err)
+		}
+		reconciled++
+
+		if !done {
+			continue
+		}
+		next, errMsg := reportOutcome(report)
+		if next == "" {
+			continue
+		}
+		err = s.transitionStatus(notificationLog.NotificationID, next, errMsg, StatusSourceReconciler)
+		if errors.Is(err, apperrors.ErrConflict) {
+			// A webhook or caller moved it on in the meantime
+			log.Printf("Not reconciling notification %s: %v", notificationLog.NotificationID, err)
+			continue
+		}
+		if err != nil {
+			return reconciled, err
+		}
+	}
+	return reconciled, nil
+}
+
+// providerMessageIDs returns the distinct message IDs provider gave the deliveries of a
+// notification. A send split into batches or failed over has one per provider call.
+func (s *pushService) providerMessageIDs(notificationID, provider string) ([]string, error) {
+	deliveries, err := s.pushRepo.GetNotificationDeliveries(notificationID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, d := range deliveries {
+		if d.Provider == provider && d.ProviderMessageID != "" && !slices.Contains(ids, d.ProviderMessageID) {
+			ids = append(ids, d.ProviderMessageID)
+		}
+	}
+	return ids, nil
+}
+
+// fetchReports fetches the report of each provider message and adds them up. The
+// notification is done sending once every message is.
+func fetchReports(reporter client.NotificationReporter, messageIDs []string) (*client.NotificationReport, bool, error) {
+	total := &client.NotificationReport{Canceled: len(messageIDs) > 0}
+	done := len(messageIDs) > 0
+	for _, id := range messageIDs {
+		report, err := reporter.NotificationReport(id)
+		if err != nil {
+			return nil, false, err
+		}
+		total.Successful += report.Successful
+		total.Failed += report.Failed
+		total.Errored += report.Errored
+		total.Converted += report.Converted
+		total.Remaining += report.Remaining
+		total.Canceled = total.Canceled && report.Canceled
+		done = done && report.Done()
+	}
+	return total, done, nil
+}
+
+// reportOutcome maps a finished provider report onto the notification's final status.
+// It returns no status for a cancelled notification, which is left to expire.
+func reportOutcome(report *client.NotificationReport) (dto.NotificationStatus, *string) {
+	switch {
+	case report.Successful > 0:
+		return dto.NotificationStatusDelivered, nil
+	case report.Canceled:
+		return "", nil
+	default:
+		errMsg := fmt.Sprintf("onesignal: %d failed, %d errored", report.Failed, report.Errored)
+		return dto.NotificationStatusFailed, &errMsg
+	}
+}
+
+// ExpireStaleNotifications moves up to limit notifications that are still queued or sending
+// after olderThan to expired, and as many sent alerts that are waiting on a OneSignal report.
+// Only OneSignal reports delivery outcomes, so sent is as far as a silent push or an alert
+// sent through any other provider gets; those are left alone.
+func (s *pushService) ExpireStaleNotifications(olderThan time.Duration, limit int) (int, error) {
+	before := time.Now().Add(-olderThan)
+	unsent := []string{string(dto.NotificationStatusQueued), string(dto.NotificationStatusSending)}
+
+	var stale []models.NotificationLog
+	for _, kind := range []string{dto.NotificationKindAlert, dto.NotificationKindSilent} {
+		logs, err := s.pushRepo.GetStaleNotifications(kind, unsent, before, limit)
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch stale notifications: %w", err)
+		}
+		stale = append(stale, logs...)
+	}
+	logs, err := s.pushRepo.GetStaleSentNotifications(dto.NotificationKindAlert, client.ProviderOneSignal, before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch stale notifications: %w", err)
+	}
+	stale = append(stale, logs...)
+
+	expired := 0
+	errMsg := fmt.Sprintf("no delivery outcome within %v", olderThan)
+	for _, notificationLog := range stale {
+		err := s.transitionStatus(notificationLog.NotificationID, dto.NotificationStatusExpired, &errMsg, StatusSourceReconciler)
+		if errors.Is(err, apperrors.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	if expired > 0 {
+		log.Printf("Expired %d notification(s) without a delivery outcome", expired)
+	}
+	return expired, nil
+}
+
+// reporter returns the named provider if it reports delivery outcomes
+func (s *pushService) reporter(name string) (client.NotificationReporter, bool) {
+	if router, ok := s.provider.(*client.Router); ok {
+		return router.Reporter(name)
+	}
+	if s.provider == nil || s.provider.Name() != name {
+		return nil, false
+	}
+	reporter, ok := s.provider.(client.NotificationReporter)
+	return reporter, ok
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/client"
+	"github.com/whotterre/push_microservice/internal/dto"
+	"github.com/whotterre/push_microservice/internal/models"
+)
+
+// addStaleLog stores a notification log created an hour ago in status
+func addStaleLog(t *testing.T, repo *fakePushRepo, notificationID string, status dto.NotificationStatus) {
+	t.Helper()
+	if err := repo.CreateNotificationLog(&models.NotificationLog{
+		NotificationID: notificationID,
+		Kind:           dto.NotificationKindAlert,
+		Status:         string(status),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	repo.logs[notificationID].CreatedAt = time.Now().Add(-time.Hour)
+}
+
+func TestExpireStaleNotificationsExpiresStuckSends(t *testing.T) {
+	repo := newFakePushRepo()
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), &fakeProvider{})
+	addStaleLog(t, repo, "notif-stuck", dto.NotificationStatusSending)
+	addStaleLog(t, repo, "notif-queued", dto.NotificationStatusQueued)
+
+	// A batch of one: the stuck send must not hold the batch and starve the queued one
+	for _, want := range []string{"notif-stuck", "notif-queued"} {
+		expired, err := s.ExpireStaleNotifications(time.Minute, 1)
+		if err != nil || expired != 1 {
+			t.Fatalf("expired %d, err %v; want 1 expired", expired, err)
+		}
+		notificationLog, _ := repo.GetNotificationLog(want)
+		if notificationLog.Status != string(dto.NotificationStatusExpired) {
+			t.Errorf("%s is %s, want expired", want, notificationLog.Status)
+		}
+	}
+}
+
+func TestExpireStaleNotificationsOnlyExpiresSentOneSignalAlerts(t *testing.T) {
+	repo := newFakePushRepo()
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), &fakeProvider{})
+	addStaleLog(t, repo, "notif-apns", dto.NotificationStatusSent)
+	addStaleLog(t, repo, "notif-onesignal", dto.NotificationStatusSent)
+	repo.CreateNotificationDeliveries([]models.NotificationDelivery{
+		{NotificationID: "notif-apns", DeviceID: 1, Provider: client.ProviderAPNs, ProviderMessageID: "apns-1", Status: "sent"},
+		{NotificationID: "notif-onesignal", DeviceID: 2, Provider: client.ProviderOneSignal, ProviderMessageID: "os-1", Status: "sent"},
+	})
+
+	expired, err := s.ExpireStaleNotifications(time.Minute, 10)
+	if err != nil || expired != 1 {
+		t.Fatalf("expired %d, err %v; want 1 expired", expired, err)
+	}
+	// APNs never reports an outcome, so sent is final for it
+	for id, want := range map[string]dto.NotificationStatus{"notif-apns": dto.NotificationStatusSent, "notif-onesignal": dto.NotificationStatusExpired} {
+		if notificationLog, _ := repo.GetNotificationLog(id); notificationLog.Status != string(want) {
+			t.Errorf("%s is %s, want %s", id, notificationLog.Status, want)
+		}
+	}
+}
+
+// fakeReportingProvider is a fakeProvider that reports delivery outcomes
+type fakeReportingProvider struct {
+	*fakeProvider
+	reports   map[string]*client.NotificationReport
+	requested []string
+}
+
+func (p *fakeReportingProvider) NotificationReport(id string) (*client.NotificationReport, error) {
+	p.requested = append(p.requested, id)
+	return p.reports[id], nil
+}
+
+func TestReconcileNotificationsUsesOneSignalDeliveries(t *testing.T) {
+	player2, player3 := "player-2", "player-3"
+	repo := newFakePushRepo(
+		models.UserDevice{ID: 1, UserID: "user-1", Provider: client.ProviderAPNs, Token: "apns-token", Platform: "ios", IsActive: true},
+		models.UserDevice{ID: 2, UserID: "user-1", PlayerID: &player2, Platform: "android", IsActive: true},
+		models.UserDevice{ID: 3, UserID: "user-1", PlayerID: &player3, Platform: "android", IsActive: true},
+	)
+	completed := time.Now().Unix()
+	provider := &fakeReportingProvider{
+		// APNs answered first, and OneSignal took the Android devices in two calls
+		fakeProvider: &fakeProvider{outcomes: []fakeOutcome{{res: &client.SendResult{
+			Provider:   "apns,onesignal",
+			ID:         "apns-1",
+			Recipients: 3,
+			Results: []client.DeviceResult{
+				{Provider: client.ProviderAPNs, Token: "apns-token", MessageID: "apns-1"},
+				{Provider: client.ProviderOneSignal, Token: player2, MessageID: "os-a"},
+				{Provider: client.ProviderOneSignal, Token: player3, MessageID: "os-b"},
+			},
+		}}}},
+		reports: map[string]*client.NotificationReport{
+			"os-a": {Failed: 1, CompletedAt: &completed},
+			"os-b": {Successful: 1, Converted: 1, CompletedAt: &completed},
+		},
+	}
+	s := newTestPushService(repo, newFakeIdempotencyRepo(), provider)
+	if _, err := s.SendPushNotification(&dto.PushRequest{NotificationID: "notif-5", UserID: "user-1", Title: "Hi", Message: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reconciled, err := s.ReconcileNotifications(10)
+	if err != nil || reconciled != 1 {
+		t.Fatalf("reconciled %d, err %v; want 1", reconciled, err)
+	}
+	slices.Sort(provider.requested)
+	if !slices.Equal(provider.requested, []string{"os-a", "os-b"}) {
+		t.Errorf("requested reports %v, want the two OneSignal messages", provider.requested)
+	}
+	notificationLog, _ := repo.GetNotificationLog("notif-5")
+	if notificationLog.Status != string(dto.NotificationStatusDelivered) || notificationLog.Successful != 1 || notificationLog.Failed != 1 {
+		t.Errorf("log = %s with %d successful, %d failed; want delivered with the summed counts",
+			notificationLog.Status, notificationLog.Successful, notificationLog.Failed)
+	}
+
+	// A OneSignal webhook names the OneSignal message, not the first provider's
+	if found, err := repo.GetNotificationLog("os-b"); err != nil || found.NotificationID != "notif-5" {
+		t.Errorf("lookup by OneSignal message ID = %v, %v; want notif-5", found, err)
+	}
+}
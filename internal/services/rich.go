@@ -0,0 +1,140 @@
+package services
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/dto"
+)
+
+// Limits on rich content, kept within what OneSignal, FCM and APNs accept
+const (
+	maxRichURLLength  = 2048
+	maxButtons        = 3
+	maxButtonText     = 64
+	maxRichNameLength = 100 // sound, android_channel_id, group
+	maxBadgeIncrement = 1000
+
+	maxTTL              = 28 * 24 * 60 * 60 // seconds, the longest FCM and OneSignal keep a push
+	maxCollapseIDLength = 32                // Web Push Topic limit, the strictest of the providers
+)
+
+// validateRichContent checks a push request's images, links, buttons, sound, badge and
+// grouping fields before anything is sent
+func validateRichContent(req *dto.PushRequest) error {
+	if err := validateWebURL("image_url", req.ImageURL); err != nil {
+		return err
+	}
+	if err := validateWebURL("url", req.URL); err != nil {
+		return err
+	}
+	if err := validateDeepLink(req.DeepLink); err != nil {
+		return err
+	}
+
+	if len(req.Buttons) > maxButtons {
+		return apperrors.Validation("buttons: at most %d buttons are allowed, got %d", maxButtons, len(req.Buttons))
+	}
+	ids := make(map[string]bool, len(req.Buttons))
+	for i, button := range req.Buttons {
+		if button.ID == "" || button.Text == "" {
+			return apperrors.Validation("buttons[%d]: id and text are required", i)
+		}
+		if ids[button.ID] {
+			return apperrors.Validation("buttons[%d]: duplicate id %q", i, button.ID)
+		}
+		ids[button.ID] = true
+		if len(button.Text) > maxButtonText {
+			return apperrors.Validation("buttons[%d]: text must be at most %d characters", i, maxButtonText)
+		}
+		if err := validateWebURL("buttons[].url", button.URL); err != nil {
+			return err
+		}
+	}
+
+	if strings.ContainsAny(req.Sound, `/\`) {
+		return apperrors.Validation("sound must be a file name, not a path")
+	}
+	for _, f := range []struct{ field, value string }{
+		{"sound", req.Sound},
+		{"android_channel_id", req.AndroidChannelID},
+		{"group", req.Group},
+	} {
+		if len(f.value) > maxRichNameLength {
+			return apperrors.Validation("%s must be at most %d characters", f.field, maxRichNameLength)
+		}
+	}
+
+	if req.BadgeIncrement > maxBadgeIncrement || req.BadgeIncrement < -maxBadgeIncrement {
+		return apperrors.Validation("badge_increment must be between -%d and %d", maxBadgeIncrement, maxBadgeIncrement)
+	}
+	return nil
+}
+
+// validateDeliveryOptions checks priority, ttl and collapse_id. A collapse_id has to be
+// a valid Web Push Topic: at most 32 URL-safe base64 characters.
+func validateDeliveryOptions(req *dto.PushRequest) error {
+	switch req.Priority {
+	case "", "high", "normal":
+	default:
+		return apperrors.Validation("priority must be high or normal, got %q", req.Priority)
+	}
+	if req.TTL != nil && (*req.TTL < 0 || *req.TTL > maxTTL) {
+		return apperrors.Validation("ttl must be between 0 and %d seconds", maxTTL)
+	}
+	if len(req.CollapseID) > maxCollapseIDLength {
+		return apperrors.Validation("collapse_id must be at most %d characters", maxCollapseIDLength)
+	}
+	for _, r := range req.CollapseID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return apperrors.Validation("collapse_id may only contain letters, digits, - and _")
+		}
+	}
+	return nil
+}
+
+// validateWebURL requires an absolute http or https URL, when one is given
+func validateWebURL(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > maxRichURLLength {
+		return apperrors.Validation("%s must be at most %d characters", field, maxRichURLLength)
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return apperrors.Validation("%s must be an absolute http or https URL", field)
+	}
+	return nil
+}
+
+// validateDeepLink requires an absolute URI in any scheme, e.g. myapp://orders/234
+func validateDeepLink(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > maxRichURLLength {
+		return apperrors.Validation("deep_link must be at most %d characters", maxRichURLLength)
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || strings.ContainsAny(value, " \t\r\n") {
+		return apperrors.Validation("deep_link must be an absolute URI such as myapp://path")
+	}
+	return nil
+}
+
+// validateSilentPush checks a data-only push: it needs data for the app to act on and
+// carries nothing to display
+func validateSilentPush(req *dto.PushRequest) error {
+	if len(req.Data) == 0 {
+		return apperrors.Validation("silent pushes require data")
+	}
+	if req.Title != "" || req.Message != "" || len(req.Titles) > 0 || len(req.Messages) > 0 || req.TemplateID != "" {
+		return apperrors.Validation("silent pushes carry data only: title, message, titles, messages and template_id are not allowed")
+	}
+	if req.ImageURL != "" || req.URL != "" || req.DeepLink != "" || len(req.Buttons) > 0 || req.Sound != "" || req.BadgeIncrement != 0 {
+		return apperrors.Validation("silent pushes carry data only: image_url, url, deep_link, buttons, sound and badge_increment are not allowed")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/dto"
+)
+
+func TestValidateRichContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     dto.PushRequest
+		wantErr bool
+	}{
+		{name: "no rich content", req: dto.PushRequest{}},
+		{
+			name: "all fields valid",
+			req: dto.PushRequest{
+				ImageURL:         "https://cdn.example.com/banner.png",
+				URL:              "https://shop.example.com/sale",
+				DeepLink:         "myapp://orders/234",
+				Buttons:          []dto.PushButton{{ID: "view", Text: "View"}, {ID: "later", Text: "Later", URL: "https://shop.example.com"}},
+				Sound:            "chime.wav",
+				AndroidChannelID: "orders",
+				Group:            "order-234",
+				BadgeIncrement:   1,
+			},
+		},
+		{name: "relative image url", req: dto.PushRequest{ImageURL: "/banner.png"}, wantErr: true},
+		{name: "non-web url", req: dto.PushRequest{URL: "ftp://example.com/file"}, wantErr: true},
+		{name: "url too long", req: dto.PushRequest{URL: "https://example.com/" + strings.Repeat("a", maxRichURLLength)}, wantErr: true},
+		{name: "deep link without scheme", req: dto.PushRequest{DeepLink: "orders/234"}, wantErr: true},
+		{name: "deep link with spaces", req: dto.PushRequest{DeepLink: "myapp://orders 234"}, wantErr: true},
+		{
+			name:    "too many buttons",
+			req:     dto.PushRequest{Buttons: []dto.PushButton{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}, {ID: "c", Text: "C"}, {ID: "d", Text: "D"}}},
+			wantErr: true,
+		},
+		{name: "button without text", req: dto.PushRequest{Buttons: []dto.PushButton{{ID: "a"}}}, wantErr: true},
+		{name: "duplicate button ids", req: dto.PushRequest{Buttons: []dto.PushButton{{ID: "a", Text: "A"}, {ID: "a", Text: "B"}}}, wantErr: true},
+		{name: "button text too long", req: dto.PushRequest{Buttons: []dto.PushButton{{ID: "a", Text: strings.Repeat("x", maxButtonText+1)}}}, wantErr: true},
+		{name: "button with bad url", req: dto.PushRequest{Buttons: []dto.PushButton{{ID: "a", Text: "A", URL: "javascript:alert(1)"}}}, wantErr: true},
+		{name: "sound path", req: dto.PushRequest{Sound: "../chime.wav"}, wantErr: true},
+		{name: "group too long", req: dto.PushRequest{Group: strings.Repeat("g", maxRichNameLength+1)}, wantErr: true},
+		{name: "badge increment too large", req: dto.PushRequest{BadgeIncrement: maxBadgeIncrement + 1}, wantErr: true},
+		{name: "badge decrement", req: dto.PushRequest{BadgeIncrement: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRichContent(&tt.req)
+			if tt.wantErr && !errors.Is(err, apperrors.ErrValidation) {
+				t.Errorf("err = %v, want a validation error", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestValidateDeliveryOptions(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	tests := []struct {
+		name    string
+		req     dto.PushRequest
+		wantErr bool
+	}{
+		{name: "no options", req: dto.PushRequest{}},
+		{name: "all options", req: dto.PushRequest{Priority: "high", TTL: intPtr(300), CollapseID: "login-code_2"}},
+		{name: "normal priority", req: dto.PushRequest{Priority: "normal"}},
+		{name: "unknown priority", req: dto.PushRequest{Priority: "urgent"}, wantErr: true},
+		{name: "ttl of zero", req: dto.PushRequest{TTL: intPtr(0)}},
+		{name: "longest ttl", req: dto.PushRequest{TTL: intPtr(maxTTL)}},
+		{name: "negative ttl", req: dto.PushRequest{TTL: intPtr(-1)}, wantErr: true},
+		{name: "ttl too long", req: dto.PushRequest{TTL: intPtr(maxTTL + 1)}, wantErr: true},
+		{name: "collapse id too long", req: dto.PushRequest{CollapseID: strings.Repeat("c", maxCollapseIDLength+1)}, wantErr: true},
+		{name: "collapse id not a topic", req: dto.PushRequest{CollapseID: "login code"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDeliveryOptions(&tt.req)
+			if tt.wantErr && !errors.Is(err, apperrors.ErrValidation) {
+				t.Errorf("err = %v, want a validation error", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/client"
+)
+
+// maxRenderedTemplates bounds the render cache; it is cleared when full
+const maxRenderedTemplates = 1000
+
+type templateVersion struct {
+	version   int
+	checkedAt time.Time
+}
+
+// TemplateRenderer renders push templates through the template service. Rendered
+// output is cached by template version, language and variables, so it is reused
+// until the template is updated; a template's version is re-checked every versionTTL.
+type TemplateRenderer struct {
+	client     *client.TemplateClient
+	versionTTL time.Duration
+
+	mu       sync.Mutex
+	versions map[string]templateVersion
+	rendered map[string]*client.RenderedTemplate
+}
+
+func NewTemplateRenderer(templateClient *client.TemplateClient, versionTTL time.Duration) *TemplateRenderer {
+	if versionTTL <= 0 {
+		versionTTL = time.Minute
+	}
+	return &TemplateRenderer{
+		client:     templateClient,
+		versionTTL: versionTTL,
+		versions:   make(map[string]templateVersion),
+		rendered:   make(map[string]*client.RenderedTemplate),
+	}
+}
+
+// Render returns the template's subject and content in language with variables substituted
+func (r *TemplateRenderer) Render(templateID, language string, variables map[string]string) (*client.RenderedTemplate, error) {
+	version, err := r.version(templateID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := renderKey(templateID, version, language, variables)
+	r.mu.Lock()
+	rendered, ok := r.rendered[key]
+	r.mu.Unlock()
+	if ok {
+		return rendered, nil
+	}
+
+	rendered, err = r.client.RenderTemplate(templateID, language, variables)
+	if err != nil {
+		return nil, templateError(templateID, err)
+	}
+	if len(rendered.VariablesMissing) > 0 {
+		return nil, apperrors.Validation("template %s is missing variables: %s", templateID, strings.Join(rendered.VariablesMissing, ", "))
+	}
+
+	r.mu.Lock()
+	if len(r.rendered) >= maxRenderedTemplates {
+		r.rendered = make(map[string]*client.RenderedTemplate)
+	}
+	r.rendered[key] = rendered
+	r.mu.Unlock()
+	return rendered, nil
+}
+
+// version returns the template's current version, fetching it when not checked recently
+func (r *TemplateRenderer) version(templateID string) (int, error) {
+	r.mu.Lock()
+	cached, ok := r.versions[templateID]
+	r.mu.Unlock()
+	if ok && time.Since(cached.checkedAt) < r.versionTTL {
+		return cached.version, nil
+	}
+
+	template, err := r.client.GetTemplate(templateID)
+	if err != nil {
+		return 0, templateError(templateID, err)
+	}
+	if template.Type != "" && template.Type != "push" {
+		return 0, apperrors.Validation("template %s is a %s template, not a push template", templateID, template.Type)
+	}
+	if !template.Active {
+		return 0, apperrors.Validation("template %s is not active", templateID)
+	}
+
+	r.mu.Lock()
+	r.versions[templateID] = templateVersion{version: template.Version, checkedAt: time.Now()}
+	r.mu.Unlock()
+	return template.Version, nil
+}
+
+// templateError maps the template service's 404 and 400 onto not-found and validation errors
+func templateError(templateID string, err error) error {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusNotFound:
+			return apperrors.NotFound("template %s not found", templateID)
+		case apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnprocessableEntity:
+			return apperrors.Validation("template %s could not be rendered: %s", templateID, apiErr.Message)
+		}
+	}
+	return fmt.Errorf("failed to render template %s: %w", templateID, err)
+}
+
+// renderKey identifies one rendering of one template version
+func renderKey(templateID string, version int, language string, variables map[string]string) string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(variables[name]))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s@%d/%s/%s", templateID, version, language, hex.EncodeToString(h.Sum(nil)))
+}
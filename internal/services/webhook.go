@@ -0,0 +1,142 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+	"github.com/whotterre/push_microservice/internal/dto"
+	"gorm.io/gorm"
+)
+
+// HandleOneSignalWebhook verifies a OneSignal event webhook and applies it. Any of
+// the events means the notification reached the device, so the notification moves
+// to delivered and the device's delivery record gets the event's timestamp.
+// Events for notifications we did not send are acknowledged and ignored.
+func (s *pushService) HandleOneSignalWebhook(body []byte, signature, secret string) error {
+	if err := verifyWebhook(s.cfg.OneSignalWebhookSecret, s.cfg.OneSignalSecretInQuery, body, signature, secret); err != nil {
+		return err
+	}
+
+	var event dto.OneSignalWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return apperrors.Validation("invalid webhook body: %w", err)
+	}
+	switch event.Event {
+	case dto.OneSignalEventDisplayed, dto.OneSignalEventClicked, dto.OneSignalEventDismissed:
+	default:
+		return apperrors.Validation("unsupported OneSignal event: %q", event.Event)
+	}
+	notificationID := event.ID
+	if notificationID == "" {
+		notificationID = event.NotificationID
+	}
+	if notificationID == "" {
+		return apperrors.Validation("webhook carries no notification id")
+	}
+
+	at := time.Now()
+	if event.Timestamp > 0 {
+		at = time.Unix(event.Timestamp, 0)
+	}
+
+	notificationLog, err := s.pushRepo.GetNotificationLog(notificationID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Ignoring OneSignal %s for unknown notification %s", event.Event, notificationID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch notification log: %w", err)
+	}
+
+	err = s.transitionStatus(notificationLog.NotificationID, dto.NotificationStatusDelivered, nil, StatusSourceWebhook)
+	if errors.Is(err, apperrors.ErrConflict) {
+		// e.g. a late display event for a notification that already expired
+		log.Printf("Not marking notification %s delivered: %v", notificationLog.NotificationID, err)
+	} else if err != nil {
+		return err
+	}
+
+	return s.recordDeliveryEvent(notificationLog.NotificationID, event.UserID, event.Event, at)
+}
+
+// recordDeliveryEvent stamps a webhook event on the delivery record of the player's device
+func (s *pushService) recordDeliveryEvent(notificationID, playerID, event string, at time.Time) error {
+	if playerID == "" {
+		return nil
+	}
+	device, err := s.pushRepo.GetDeviceByPlayerID(playerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch device: %w", err)
+	}
+	delivery, err := s.pushRepo.GetNotificationDelivery(notificationID, device.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch delivery: %w", err)
+	}
+
+	if dto.NotificationStatus(delivery.Status).CanTransitionTo(dto.NotificationStatusDelivered) {
+		delivery.Status = string(dto.NotificationStatusDelivered)
+	}
+	if delivery.DeliveredAt == nil {
+		delivery.DeliveredAt = &at
+	}
+	switch event {
+	case dto.OneSignalEventClicked:
+		if delivery.ClickedAt == nil {
+			delivery.ClickedAt = &at
+		}
+	case dto.OneSignalEventDismissed:
+		if delivery.DismissedAt == nil {
+			delivery.DismissedAt = &at
+		}
+	}
+
+	if err := s.pushRepo.UpdateNotificationDelivery(delivery); err != nil {
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+	return nil
+}
+
+// verifyWebhook accepts a webhook signed with the shared secret in the signature
+// header, or, when allowQuery is set for senders that cannot sign, carrying the
+// secret as a query parameter
+func verifyWebhook(configured string, allowQuery bool, body []byte, signature, secret string) error {
+	if configured == "" {
+		return apperrors.Unauthorized("webhook secret is not configured")
+	}
+
+	if signature != "" {
+		got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+		if err != nil {
+			return apperrors.Unauthorized("invalid webhook signature")
+		}
+		mac := hmac.New(sha256.New, []byte(configured))
+		mac.Write(body)
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return apperrors.Unauthorized("invalid webhook signature")
+		}
+		return nil
+	}
+
+	if !allowQuery {
+		return apperrors.Unauthorized("missing webhook signature")
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(configured)) != 1 {
+		return apperrors.Unauthorized("missing or invalid webhook secret")
+	}
+	return nil
+}
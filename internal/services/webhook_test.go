@@ -0,0 +1,45 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/whotterre/push_microservice/internal/apperrors"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"event":"notification.clicked","id":"notif-1"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name       string
+		configured string
+		allowQuery bool
+		signature  string
+		secret     string
+		wantErr    bool
+	}{
+		{name: "valid signature", configured: "s3cret", signature: signature},
+		{name: "wrong signature", configured: "s3cret", signature: "sha256=00ff", wantErr: true},
+		{name: "query secret refused by default", configured: "s3cret", secret: "s3cret", wantErr: true},
+		{name: "query secret when allowed", configured: "s3cret", allowQuery: true, secret: "s3cret"},
+		{name: "wrong query secret", configured: "s3cret", allowQuery: true, secret: "guess", wantErr: true},
+		{name: "secret not configured", signature: signature, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyWebhook(tt.configured, tt.allowQuery, body, tt.signature, tt.secret)
+			if tt.wantErr && !errors.Is(err, apperrors.ErrUnauthorized) {
+				t.Errorf("err = %v, want unauthorized", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}